@@ -5,51 +5,585 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
 	"encoding/csv"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/oklasoft/mmatcher/matcher"
 	"gopkg.in/alecthomas/kingpin.v1"
 )
 
-func loadData(path string, skipHeader bool) matcher.Records {
+// A format says how a data file is laid out: if it has a header row, its
+// delimiter (or auto to sniff it), quote character (or none) & comment
+// character, if any, along with the tokens for a missing value & the columns
+// making up the ID
+type format struct {
+	header  bool
+	comma   string
+	quote   string
+	comment string
+	missing []string
+	ids     []string
+}
+
+// reader returns a Reader of in for the format
+func (f format) reader(in io.Reader) *matcher.Reader {
+	reader := matcher.NewReader(in)
+	reader.SkipHeader = f.header
+	reader.Missing = append(reader.Missing, f.missing...)
+	reader.IDColumns = f.ids
+	if "auto" == f.comma {
+		reader.Sniff = true
+	} else {
+		reader.Comma = parseChar("delimiter", f.comma)
+	}
+	if "none" == f.quote {
+		reader.Quote = 0
+	} else {
+		reader.Quote = parseChar("quote", f.quote)
+	}
+	if "" != f.comment {
+		reader.Comment = parseChar("comment", f.comment)
+	}
+	return reader
+}
+
+// parseChar returns the single character in s, which can be escaped like \t
+func parseChar(name, s string) rune {
+	if 1 == utf8.RuneCountInString(s) {
+		return []rune(s)[0]
+	}
+	c, err := strconv.Unquote("'" + s + "'")
+	if nil != err {
+		log.Fatalf("The %s %q must be a single character", name, s)
+	}
+	return []rune(c)[0]
+}
+
+// openData opens the file at path for reading Records from in format f
+func openData(path string, f format) (*os.File, *matcher.Reader) {
 	file, err := os.Open(path)
 	if nil != err {
 		log.Fatal(err)
 	}
+	return file, f.reader(file)
+}
+
+// loadData reads all the Records from the file at path, along with its header
+// row if it has one
+func loadData(path string, f format) (matcher.IndexedRecords, []string) {
+	file, reader := openData(path, f)
 	defer file.Close()
 
-	data, err := matcher.NewRecordsFromCSV(file, skipHeader)
+	data, err := reader.ReadAll()
+	if nil != err {
+		log.Fatalf("%s: %s", path, err)
+	}
+	header, err := reader.Header()
+	if nil != err {
+		log.Fatalf("%s: %s", path, err)
+	}
+	return data, header
+}
+
+// readHeader returns the header row of the file at path, nil if it has none
+func readHeader(path string, f format) []string {
+	file, reader := openData(path, f)
+	defer file.Close()
+
+	header, err := reader.Header()
+	if nil != err && io.EOF != err {
+		log.Fatalf("%s: %s", path, err)
+	}
+	return header
+}
+
+// checkAligned makes sure each of the columns at positions, as numbered or
+// named in the case header, has one column of the same name in the control
+// header to be aligned with
+func checkAligned(positions []int, header, controlHeader []string) {
+	columns := matcher.HeaderColumns(controlHeader)
+	for _, p := range positions {
+		if p < 0 || p+1 >= len(header) {
+			continue
+		}
+		name := header[p+1]
+		if c, ok := columns[strings.TrimSpace(name)]; !ok {
+			log.Fatalf("Column %q is not in the header of %s to align with", name, *control_file)
+		} else if c < 0 {
+			log.Fatalf("Column %q is in the header of %s more than once", name, *control_file)
+		}
+	}
+}
+
+// A controlStream reads Records from a file a row at a time, each prepared as
+// the loaded Records would be. The file is closed once all are read
+type controlStream struct {
+	file    *os.File
+	reader  *matcher.Reader
+	prepare func(*matcher.Record)
+}
+
+func (s *controlStream) Read() (matcher.Record, error) {
+	r, err := s.reader.Read()
+	if nil != err {
+		s.file.Close()
+		if io.EOF != err {
+			err = fmt.Errorf("%s: %s", s.file.Name(), err)
+		}
+		return r, err
+	}
+	s.prepare(&r)
+	return r, nil
+}
+
+// streamedControls reads the controls matched in opti from open, for the
+// verbose output when the controls are streamed rather than loaded
+func streamedControls(open func() (matcher.RecordReader, error), opti matcher.MatchSet, cases matcher.Records) matcher.IndexedRecords {
+	matched := make(map[string]bool)
+	for _, r := range cases {
+		for _, id := range opti.MatchesFor(r.ID) {
+			matched[id] = true
+		}
+	}
+	in, err := open()
+	if nil != err {
+		log.Fatal(err)
+	}
+	controls := matcher.Records{}
+	for {
+		r, err := in.Read()
+		if io.EOF == err {
+			break
+		} else if nil != err {
+			log.Fatal(err)
+		}
+		if matched[r.ID] {
+			controls = append(controls, r)
+		}
+	}
+	return controls.Indexed()
+}
+
+// loadPCs reads the top n principal components from the .eigenvec file at
+// path, keyed by IID, or by FID & IID joined by sep unless sep is ""
+func loadPCs(path string, n int, sep string) map[string]matcher.PCAtt {
+	file, err := os.Open(path)
+	if nil != err {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	pcs, err := matcher.NewPCsFromEigenvecByFID(file, n, sep)
 	if nil != err {
 		log.Fatal(err)
 	}
-	return data
+	return pcs
 }
 
-func parseKeys(s string) ([]int, []matcher.Atter) {
+// attachPCs adds the principal components in pcs to the cases & controls,
+// returning the position of the new attribute
+func attachPCs(path string, pcs map[string]matcher.PCAtt, r ...matcher.Records) int {
+	p, missing := matcher.AttachPCs(pcs, r...)
+	for _, id := range missing {
+		log.Printf("Warning: %s has no principal components in %s", id, path)
+	}
+	return p
+}
+
+func loadEquivalences(path string) map[string]matcher.EquivAtt {
+	file, err := os.Open(path)
+	if nil != err {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	q, err := matcher.NewEquivalencesFromCSV(file)
+	if nil != err {
+		log.Fatal(err)
+	}
+	return q
+}
+
+// applyEquivalences swaps in the classes from q as the ranges for any of the
+// keys whose columns they cover, given by number or one of the names in columns
+func applyEquivalences(q map[string]matcher.EquivAtt, keys matcher.Keys, columns map[string]int) {
+	for k, v := range q {
+		p, err := lookupColumn(k, columns)
+		if nil != err {
+			log.Fatalf("Equivalence %s", err)
+		}
+		for i := range keys {
+			if keys[i].Position != p {
+				continue
+			}
+			if nil != keys[i].Range {
+				log.Fatalf("Key column %s cannot have both a range & equivalences", k)
+			}
+			keys[i].Range = v
+		}
+	}
+}
+
+// warnUnmapped logs any values in the key columns of r without an equivalence
+func warnUnmapped(name string, r matcher.Records, keys matcher.Keys) {
+	for _, w := range unmapped(name, r, keys) {
+		log.Print(w)
+	}
+}
+
+// unmapped returns a warning for each value in the key columns of r without an
+// equivalence
+func unmapped(name string, r matcher.Records, keys matcher.Keys) (w []string) {
+	for _, k := range keys {
+		q, ok := k.Range.(matcher.EquivAtt)
+		if !ok {
+			continue
+		}
+		for _, v := range q.Unmapped(r, k.Position) {
+			w = append(w, fmt.Sprintf("Warning: %s column %d value %q has no equivalence", name, k.Position+1, v))
+		}
+	}
+	return w
+}
+
+// parseKeys turns the keys arg into Tiers. Each key is a column number, or
+// name from columns, followed by optional : separated parts, either a number for the +/- range,
+// abs to compare absolute values or an option=value such as missing=any. A
+// range may be a / separated list of successively wider ranges, each used in
+// turn as a tier for cases still without enough matches. A key of two columns
+// joined by + with the geo part is a latitude & longitude pair, whose range
+// can have a km, m or mi unit. Such pairs are returned by their latitude
+// column mapped to their longitude
+func parseKeys(s string, missing matcher.MissingPolicy, columns map[string]int) (matcher.Tiers, map[int]int) {
 	parts := strings.Split(s, ",")
-	positions := make([]int, len(parts))
-	ranges := make([]matcher.Atter, len(parts))
+	keys := make(matcher.Keys, len(parts))
+	ranges := make([][]matcher.Atter, len(parts))
+	abs := make([]bool, len(parts))
+	geo := make([]bool, len(parts))
+	units := make([]bool, len(parts))
+	geos := make(map[int]int)
+	n := 1
 	for i, v := range parts {
 		k := strings.Split(v, ":")
-		p, err := strconv.ParseInt(k[0], 10, 32)
-		if nil != err {
-			log.Fatal(err)
+		c := strings.Split(k[0], "+")
+		if len(c) > 2 {
+			log.Fatalf("Key %s can have at most two columns", k[0])
+		}
+		keys[i].Position = parseColumn(c[0], columns)
+		keys[i].Missing = missing
+		for _, o := range k[1:] {
+			if kv := strings.SplitN(o, "=", 2); 2 == len(kv) {
+				parseKeyOption(&keys[i], kv[0], kv[1])
+				continue
+			}
+			if "abs" == o {
+				abs[i] = true
+				continue
+			}
+			if "geo" == o {
+				geo[i] = true
+				continue
+			}
+			ranges[i] = nil
+			for _, w := range strings.Split(o, "/") {
+				r, unit := parseRange(w)
+				ranges[i] = append(ranges[i], matcher.NumericAtt{r})
+				units[i] = units[i] || unit
+			}
+			if len(ranges[i]) > n {
+				n = len(ranges[i])
+			}
+		}
+		if geo[i] != (2 == len(c)) {
+			log.Fatalf("Key %s needs both two columns & geo to be a location", v)
+		}
+		if units[i] && !geo[i] {
+			log.Fatalf("Key %s has a range in km, m or mi, but only locations can", v)
+		}
+		if geo[i] {
+			geos[keys[i].Position] = parseColumn(c[1], columns)
+		}
+		if abs[i] {
+			if 0 == len(ranges[i]) {
+				ranges[i] = []matcher.Atter{matcher.NumericAtt{}}
+			}
+			for j, r := range ranges[i] {
+				ranges[i][j] = matcher.AbsAtt{r.(matcher.NumericAtt).Val}
+			}
+		}
+	}
+	tiers := make(matcher.Tiers, n)
+	for t := range tiers {
+		tiers[t] = make(matcher.Keys, len(keys))
+		copy(tiers[t], keys)
+		for i, r := range ranges {
+			if t < len(r) {
+				tiers[t][i].Range = r[t]
+			} else if len(r) > 0 {
+				tiers[t][i].Range = r[len(r)-1]
+			}
+		}
+	}
+	return tiers, geos
+}
+
+// parseColumn returns the position of key column c, either a number starting
+// at 1 or one of the names in columns
+func parseColumn(c string, columns map[string]int) int {
+	p, err := lookupColumn(c, columns)
+	if nil != err {
+		log.Fatalf("Key %s", err)
+	}
+	return p
+}
+
+// lookupColumn returns the position of column c, either a number starting at
+// 1 or one of the names in columns, such as those from the header
+func lookupColumn(c string, columns map[string]int) (int, error) {
+	if p, err := strconv.ParseInt(c, 10, 32); nil == err {
+		if p < 1 {
+			return 0, fmt.Errorf("column %s must be 1 or more", c)
+		}
+		return int(p) - 1, nil
+	}
+	p, ok := columns[strings.TrimSpace(c)]
+	if !ok {
+		return 0, fmt.Errorf("column %s is not a number or a name in the header", c)
+	}
+	if p < 0 {
+		return 0, fmt.Errorf("column %s is in the header more than once", c)
+	}
+	return p, nil
+}
+
+// parseRange parses a number for a +/- range, which can be in km, m or mi for
+// locations, all turned into km. It also returns true if there was a unit
+func parseRange(w string) (float64, bool) {
+	units := []struct {
+		suffix string
+		km     float64
+	}{
+		{"km", 1},
+		{"mi", 1.609344},
+		{"m", 0.001},
+	}
+	scale, unit := 1.0, false
+	for _, u := range units {
+		if strings.HasSuffix(w, u.suffix) {
+			w = strings.TrimSuffix(w, u.suffix)
+			scale, unit = u.km, true
+			break
+		}
+	}
+	r, err := strconv.ParseFloat(w, 64)
+	if nil != err {
+		log.Fatal(err)
+	}
+	return r * scale, unit
+}
+
+// pairGeos combines the latitude & longitude columns in geos for r
+func pairGeos(name string, r matcher.Records, geos map[int]int) {
+	for lat, lon := range geos {
+		if err := r.PairGeo(lat, lon); nil != err {
+			log.Fatalf("%s: %s", name, err)
 		}
-		positions[i] = int(p) - 1
-		if len(k) > 1 {
-			r, err := strconv.ParseFloat(k[1], 32)
-			if nil != err {
-				log.Fatal(err)
+	}
+}
+
+// parseKeyOption sets the option named o to v on key k
+func parseKeyOption(k *matcher.Key, o, v string) {
+	var err error
+	switch o {
+	case "missing":
+		k.Missing, err = matcher.ParseMissingPolicy(v)
+	case "weight":
+		k.Weight, err = strconv.ParseFloat(v, 64)
+		if nil == err && k.Weight < 0 {
+			err = fmt.Errorf("weight cannot be negative")
+		}
+	case "priority":
+		k.Priority, err = strconv.Atoi(v)
+		if nil == err && k.Priority < 0 {
+			err = fmt.Errorf("priority cannot be negative")
+		}
+	default:
+		err = fmt.Errorf("unknown option %s", o)
+	}
+	if nil != err {
+		log.Fatalf("Key column %d: %s", k.Position+1, err)
+	}
+}
+
+// keyColumns lists the columns of keys separated by spaces, by name if they
+// have one in columns or number otherwise
+func keyColumns(keys matcher.Keys, columns map[string]int) string {
+	c := make([]string, len(keys))
+	for i, k := range keys {
+		c[i] = strconv.Itoa(k.Position + 1)
+		for n, p := range columns {
+			if p == k.Position {
+				c[i] = n
 			}
-			ranges[i] = matcher.NumericAtt{r}
 		}
 	}
-	return positions, ranges
+	return strings.Join(c, " ")
+}
+
+// inputsKey identifies the input files, by name & a hash of their contents,
+// along with every flag that changes the matches, so a checkpoint is only
+// resumed with the same ones
+func inputsKey(formats ...format) string {
+	h := sha256.New()
+	fmt.Fprintln(h, version())
+	for _, path := range []string{*case_file, *control_file, *eigenvecFile, *equivFile} {
+		if "" == path {
+			continue
+		}
+		fmt.Fprintf(h, "%q %s\n", path, hashFile(path))
+	}
+	for _, f := range formats {
+		fmt.Fprintf(h, "%t %q %q %q %q\n", f.header, f.comma, f.quote, f.comment, f.ids)
+	}
+	fmt.Fprintf(h, "%q %t %t %d %q %q %q %v %d %d %t %d\n", *key, *skipHeaders, *alignColumns, *numberMatches,
+		*missingTokens, *missingPolicy, *rule, *maxScore, *numberPCs, *keep, *keepRandom, *seed)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashFile returns the SHA-256 of the contents of the file at path, in hex
+func hashFile(path string) string {
+	file, err := os.Open(path)
+	if nil != err {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); nil != err {
+		log.Fatalf("%s: %s", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// loadCheckpoint reads the checkpoint at path, which has to be for inputs
+func loadCheckpoint(path, inputs string) *matcher.Checkpoint {
+	file, err := os.Open(path)
+	if nil != err {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	c, err := matcher.ReadCheckpoint(bufio.NewReader(file))
+	if nil != err {
+		log.Fatalf("%s: %s", path, err)
+	}
+	if inputs != c.Inputs {
+		log.Fatalf("%s: the input files, keys or options have changed since the checkpoint", path)
+	}
+	return c
+}
+
+// saveCheckpoint writes c to path, by way of a temporary file so a complete
+// checkpoint is always left behind
+func saveCheckpoint(path string, c *matcher.Checkpoint) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if nil != err {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	err = c.Write(w)
+	if nil == err {
+		err = w.Flush()
+	}
+	if cerr := file.Close(); nil == err {
+		err = cerr
+	}
+	if nil != err {
+		os.Remove(tmp)
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// progressInterval is the least time between redrawing a progressLine
+const progressInterval = 200 * time.Millisecond
+
+// A progressLine shows the Progress of a Matcher on a single line of stderr,
+// redrawn in place
+type progressLine struct {
+	last  time.Time
+	width int
+}
+
+func (l *progressLine) show(p matcher.Progress) {
+	if time.Since(l.last) < progressInterval {
+		return
+	}
+	l.last = time.Now()
+	s := fmt.Sprintf("tier %d: scanned %d", p.Tier+1, p.Scanned)
+	if p.Total > 0 {
+		s += fmt.Sprintf("/%d", p.Total)
+	}
+	s += fmt.Sprintf(", %d candidates", p.Candidates)
+	if p.Components > 0 {
+		s += fmt.Sprintf(", optimized %d/%d components in %d rounds", p.Optimized, p.Components, p.Rounds)
+	}
+	pad := ""
+	if len(s) < l.width {
+		pad = strings.Repeat(" ", l.width-len(s))
+	}
+	fmt.Fprint(os.Stderr, "\r"+s+pad)
+	l.width = len(s)
+}
+
+// clear blanks the line, so other output can be written. It does nothing for
+// a nil progressLine
+func (l *progressLine) clear() {
+	if nil == l || 0 == l.width {
+		return
+	}
+	fmt.Fprint(os.Stderr, "\r"+strings.Repeat(" ", l.width)+"\r")
+	l.width = 0
+}
+
+// isTerminal returns true if f is a terminal rather than a file or pipe
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return nil == err && 0 != fi.Mode()&os.ModeCharDevice
+}
+
+// interruptible returns a context that is cancelled by the first Ctrl-C, a
+// second one stops the program straight away as usual
+func interruptible() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		signal.Stop(sigs)
+		cancel()
+	}()
+	return ctx
+}
+
+func splitList(s string) (l []string) {
+	if "" == s {
+		return
+	}
+	return strings.Split(s, ",")
 }
 
 func version() string {
@@ -57,18 +591,100 @@ func version() string {
 }
 
 var (
-	verbose       = kingpin.Flag("verbose", "Increase verbosity").Short('v').Bool()
-	skipHeaders   = kingpin.Flag("skip-header", "Inputs have header line to be skipped, default is use everyline").Short('h').Bool()
-	outFile       = kingpin.Flag("output", "Output file").Short('o').PlaceHolder("STDOUT").OpenFile(os.O_WRONLY|os.O_CREATE, 0660)
-	numberMatches = kingpin.Flag("matches", "Allow up to N matches per case").Short('m').PlaceHolder("N").Default("1").Int()
-	outSep        = kingpin.Flag("out-separator", "Output field separator").Default(",").String()
-	key           = kingpin.Arg("keys", "Keys to compare. A comma separated list of columns starting a 1, with optional :# +/- window").Required().String()
-	case_file     = kingpin.Arg("case", "CSV file representing the cases").Required().ExistingFile()
-	control_file  = kingpin.Arg("controls", "CSV file representing the controls").Required().ExistingFile()
-	build         string
+	verbose         = kingpin.Flag("verbose", "Increase verbosity").Short('v').Bool()
+	quiet           = kingpin.Flag("quiet", "No progress line on a terminal").Short('q').Bool()
+	skipHeaders     = kingpin.Flag("skip-header", "Inputs have header line to be skipped, default is use everyline").Short('h').Bool()
+	idColumns       = kingpin.Flag("id-column", "Column of the IDs, by number starting at 1 for the first column or by header name, or a comma separated list of them joined by _ into one ID").PlaceHolder("COL,...").String()
+	caseSkip        = kingpin.Flag("case-header", "Just the case file has a header line").Bool()
+	controlSkip     = kingpin.Flag("control-header", "Just the control file has a header line").Bool()
+	caseSep         = kingpin.Flag("case-delimiter", "Field delimiter of the case file, or auto to work it out from the first lines").Default(",").String()
+	controlSep      = kingpin.Flag("control-delimiter", "Field delimiter of the control file, or auto to work it out from the first lines").Default(",").String()
+	caseQuote       = kingpin.Flag("case-quote", "Quote character of the case file, or none").Default("\"").String()
+	controlQuote    = kingpin.Flag("control-quote", "Quote character of the control file, or none").Default("\"").String()
+	caseComment     = kingpin.Flag("case-comment", "Skip lines of the case file starting with this character").PlaceHolder("CHAR").String()
+	controlComment  = kingpin.Flag("control-comment", "Skip lines of the control file starting with this character").PlaceHolder("CHAR").String()
+	outFile         = kingpin.Flag("output", "Output file").Short('o').PlaceHolder("STDOUT").OpenFile(os.O_WRONLY|os.O_CREATE, 0660)
+	numberMatches   = kingpin.Flag("matches", "Allow up to N matches per case").Short('m').PlaceHolder("N").Default("1").Int()
+	jobs            = kingpin.Flag("jobs", "Find candidate matches with N workers, 0 for one per CPU").Short('j').PlaceHolder("N").Default("0").Int()
+	keep            = kingpin.Flag("keep", "Keep only the N nearest candidate controls for each case, 0 for all").PlaceHolder("N").Default("0").Int()
+	keepRandom      = kingpin.Flag("keep-random", "Keep N random candidates for each case rather than the nearest").Bool()
+	seed            = kingpin.Flag("seed", "Seed for choosing random candidates to keep").Default("1").Int64()
+	checkpointFile  = kingpin.Flag("checkpoint", "Save progress to FILE every so often, so an interrupted run can be carried on with --resume").PlaceHolder("FILE").String()
+	checkpointEvery = kingpin.Flag("checkpoint-every", "How often to save progress to the --checkpoint file").Default("1m").Duration()
+	resume          = kingpin.Flag("resume", "Carry on from the --checkpoint file, which must be for the same inputs & keys").Bool()
+	alignColumns    = kingpin.Flag("align", "Line up the control columns with the case columns by their header names rather than position, needs -h").Bool()
+	stream          = kingpin.Flag("stream", "Read the controls a row at a time rather than loading them all, for files larger than memory").Bool()
+	compFile        = kingpin.Flag("components", "Write stats on each connected component of candidates to a CSV file").PlaceHolder("FILE").OpenFile(os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	outSep          = kingpin.Flag("out-separator", "Output field separator").Default(",").String()
+	missingTokens   = kingpin.Flag("missing", "Comma separated list of values, in addition to blank, that mean missing").PlaceHolder("NA,...").String()
+	missingPolicy   = kingpin.Flag("missing-policy", "How missing values in keys match: same (only missing), never or any").Default("same").String()
+	rule            = kingpin.Flag("rule", "Expression every case & control pair must also match, such as \"abs(a.2 - b.2) <= 5 && b.4 >= a.3\"").Short('r').PlaceHolder("EXPR").String()
+	maxScore        = kingpin.Flag("max-score", "Match keys with a weight by their combined weighted distance of at most S, instead of each on its own").PlaceHolder("S").Float()
+	eigenvecFile    = kingpin.Flag("eigenvec", "PLINK/GCTA .eigenvec file of principal components by sample ID, to match on with the pc key").PlaceHolder("FILE").ExistingFile()
+	numberPCs       = kingpin.Flag("pcs", "Use the top N principal components").PlaceHolder("N").Default("10").Int()
+	equivFile       = kingpin.Flag("equivalences", "CSV file of values to treat as equal per key column").Short('e').PlaceHolder("FILE").ExistingFile()
+	key             = kingpin.Arg("keys", "Keys to compare. A comma separated list of columns starting a 1 (or pc, or names from the header with -h), with optional :# +/- window (or :#/#/... to widen for unmatched cases), :abs, lat+lon:geo:#km, :missing=POLICY, :priority=# & :weight=#").Required().String()
+	case_file       = kingpin.Arg("case", "CSV file representing the cases").Required().ExistingFile()
+	control_file    = kingpin.Arg("controls", "CSV file representing the controls").Required().ExistingFile()
+	build           string
+
+	generate       = kingpin.New("mmatcher generate", "Write synthetic case & control CSV files, for testing & benchmarking without real data")
+	genCases       = generate.Flag("cases", "Number of cases").PlaceHolder("N").Default("1000").Int()
+	genControls    = generate.Flag("controls", "Number of controls").PlaceHolder("N").Default("10000").Int()
+	genColumns     = generate.Flag("columns", "Comma separated list of columns, each name:normal:MEAN:SD, name:uniform:MIN:MAX or name:category:LEVELS with optional :decimals=#, :missing=FRACTION & :jitter=#").PlaceHolder("SPEC").Default("sex:category:2,age:normal:50:15:jitter=3,race:category:5,bmi:uniform:18:40:decimals=1:jitter=2").String()
+	genDensity     = generate.Flag("density", "Fraction of controls made as near copies of a case, within the jitter of each column").PlaceHolder("F").Default("0.1").Float()
+	genSeed        = generate.Flag("seed", "Seed for the random values").Default("1").Int64()
+	genHeader      = generate.Flag("header", "Write a header row of column names").Bool()
+	genCaseFile    = generate.Arg("case", "CSV file to write the cases to").Required().String()
+	genControlFile = generate.Arg("controls", "CSV file to write the controls to").Required().String()
 )
 
+// runGenerate writes a synthetic cohort as given by the generate args
+func runGenerate(args []string) {
+	_, err := generate.Parse(args)
+	generate.FatalIfError(err, "")
+
+	cols, err := matcher.ParseColumns(*genColumns)
+	if nil != err {
+		log.Fatal(err)
+	}
+	if *genDensity < 0 || *genDensity > 1 {
+		log.Fatal("--density must be a fraction from 0 to 1")
+	}
+	c := matcher.Cohort{
+		Cases:    *genCases,
+		Controls: *genControls,
+		Columns:  cols,
+		Density:  *genDensity,
+		Seed:     *genSeed,
+	}
+	var header []string
+	if *genHeader {
+		header = c.Header()
+	}
+	cases, controls := c.Generate()
+	writeData(*genCaseFile, header, cases)
+	writeData(*genControlFile, header, controls)
+}
+
+func writeData(path string, header []string, r matcher.Records) {
+	file, err := os.Create(path)
+	if nil != err {
+		log.Fatal(err)
+	}
+	if err := matcher.WriteCSV(file, header, r); nil != err {
+		log.Fatalf("%s: %s", path, err)
+	}
+	if err := file.Close(); nil != err {
+		log.Fatal(err)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && "generate" == os.Args[1] {
+		runGenerate(os.Args[2:])
+		return
+	}
 	kingpin.Version(version())
 	kingpin.Parse()
 
@@ -76,20 +692,222 @@ func main() {
 		outFile = &os.Stdout
 	}
 
-	positions, ranges := parseKeys(*key)
-	cases := loadData(*case_file, *skipHeaders)
-	controls := loadData(*control_file, *skipHeaders)
+	policy, err := matcher.ParseMissingPolicy(*missingPolicy)
+	if nil != err {
+		log.Fatal(err)
+	}
+	caseFormat := format{
+		header:  *skipHeaders || *caseSkip,
+		comma:   *caseSep,
+		quote:   *caseQuote,
+		comment: *caseComment,
+		missing: splitList(*missingTokens),
+		ids:     splitList(*idColumns),
+	}
+	controlFormat := format{
+		header:  *skipHeaders || *controlSkip,
+		comma:   *controlSep,
+		quote:   *controlQuote,
+		comment: *controlComment,
+		missing: splitList(*missingTokens),
+		ids:     splitList(*idColumns),
+	}
+	all, header := loadData(*case_file, caseFormat)
+	cases := all.Records
+	controls := matcher.IndexedRecords{}
+	var controlHeader []string
+	if *stream {
+		controlHeader = readHeader(*control_file, controlFormat)
+	} else {
+		controls, controlHeader = loadData(*control_file, controlFormat)
+	}
+	var align matcher.Alignment
+	if *alignColumns {
+		if !caseFormat.header || !controlFormat.header {
+			log.Fatal("--align needs header rows in both files to align the columns by")
+		}
+		align = matcher.NewAlignment(controlHeader, header)
+		controls.Align(align)
+	}
+	columns := matcher.HeaderColumns(header)
+	var pcs map[string]matcher.PCAtt
+	if "" != *eigenvecFile {
+		sep := ""
+		if len(caseFormat.ids) > 1 {
+			sep = matcher.DefaultIDSeparator
+		}
+		pcs = loadPCs(*eigenvecFile, *numberPCs, sep)
+		if *stream {
+			columns["pc"] = attachPCs(*eigenvecFile, pcs, cases)
+		} else {
+			columns["pc"] = attachPCs(*eigenvecFile, pcs, cases, controls.Records)
+		}
+	}
+
+	tiers, geos := parseKeys(*key, policy, columns)
+	used := []int{}
+	for _, keys := range tiers {
+		used = append(used, keys.Positions()...)
+	}
+	for _, lon := range geos {
+		used = append(used, lon)
+	}
+	if "" != *equivFile {
+		q := loadEquivalences(*equivFile)
+		for _, keys := range tiers {
+			applyEquivalences(q, keys, columns)
+		}
+		for k := range q {
+			p, _ := lookupColumn(k, columns)
+			used = append(used, p)
+		}
+	}
+	var with *matcher.Rule
+	if "" != *rule {
+		if with, err = matcher.ParseRule(*rule, columns); nil != err {
+			log.Fatal(err)
+		}
+		used = append(used, with.Columns()...)
+	}
+	if nil != align {
+		checkAligned(used, header, controlHeader)
+	}
+	keys := tiers[0]
+	weighted := false
+	for _, k := range keys {
+		weighted = weighted || k.Weight > 0
+	}
+	if weighted != (*maxScore > 0) {
+		log.Fatal("Keys with a weight & --max-score must be used together")
+	}
+	dropped := tiers[len(tiers)-1].Dropped()
+	tiers = append(tiers, dropped...)
+	pairGeos(*case_file, cases, geos)
+	warnUnmapped(*case_file, cases, keys)
+	if !*stream {
+		pairGeos(*control_file, controls.Records, geos)
+		warnUnmapped(*control_file, controls.Records, keys)
+	}
 
-	all_matches := matcher.NewMatchSet()
+	m := matcher.Matcher{
+		Tiers:    tiers,
+		MaxScore: *maxScore,
+		Allowed:  *numberMatches,
+		Jobs:     *jobs,
+		Prune:    matcher.Pruning{Keep: *keep, Random: *keepRandom, Seed: *seed},
+	}
+	var progress *progressLine
+	if !*quiet && isTerminal(os.Stderr) {
+		progress = &progressLine{}
+		m.Progress = progress.show
+	}
+	if *keep > 0 {
+		m.ReportTier = func(s matcher.TierStats) {
+			progress.clear()
+			log.Printf("Tier %d: kept %d candidate pairs for %d cases, pruned %d", s.Tier+1, s.Candidates, s.Cases, s.Pruned)
+		}
+	}
+	if nil != with {
+		m.With = append(m.With, with)
+	}
 
-	for _, r := range cases {
-		spots := r.Matches(controls, positions, ranges...)
-		for _, i := range spots {
-			all_matches.AddPair(matcher.NewPair(r.ID, controls[i].ID))
+	// closeComps flushes & closes the --components file. It is deferred, but
+	// also called before exiting on an interrupt, as os.Exit skips deferrals
+	closeComps := func() {}
+	if nil != *compFile {
+		comps := csv.NewWriter(*compFile)
+		comps.Write([]string{"tier", "component", "cases", "controls", "candidates", "pairs"})
+		m.Report = func(s matcher.ComponentStats) {
+			comps.Write([]string{
+				strconv.Itoa(s.Tier + 1),
+				strconv.Itoa(s.Component + 1),
+				strconv.Itoa(s.Cases),
+				strconv.Itoa(s.Controls),
+				strconv.Itoa(s.Candidates),
+				strconv.Itoa(s.Pairs),
+			})
+		}
+		closeComps = func() {
+			comps.Flush()
+			(*compFile).Close()
 		}
+		defer closeComps()
 	}
 
-	opti := all_matches.QuantityOptimized(*numberMatches)
+	if "" != *checkpointFile {
+		inputs := inputsKey(caseFormat, controlFormat)
+		if *resume {
+			m.Resume = loadCheckpoint(*checkpointFile, inputs)
+		}
+		m.CheckpointEvery = *checkpointEvery
+		m.Checkpoint = func(c *matcher.Checkpoint) error {
+			c.Inputs = inputs
+			return saveCheckpoint(*checkpointFile, c)
+		}
+	} else if *resume {
+		log.Fatal("--resume needs the --checkpoint file to carry on from")
+	}
+
+	ctx := interruptible()
+	var opti matcher.MatchSet
+	var made map[matcher.Pair]int
+	if *stream {
+		// each warning is only given once, though the controls are read again
+		// for every tier
+		warned := make(map[string]bool)
+		warn := func(w string) {
+			if !warned[w] {
+				warned[w] = true
+				progress.clear()
+				log.Print(w)
+			}
+		}
+		prepare := func(r *matcher.Record) {
+			if nil != align {
+				align.Apply(r)
+			}
+			if nil != pcs {
+				if len(r.Atts) > columns["pc"] {
+					log.Fatalf("%s: %s has more columns than the cases to stream principal components after", *control_file, r.ID)
+				}
+				if !matcher.AttachPC(pcs, r, columns["pc"]) {
+					warn(fmt.Sprintf("Warning: %s has no principal components in %s", r.ID, *eigenvecFile))
+				}
+			}
+			pairGeos(*control_file, matcher.Records{*r}, geos)
+			for _, w := range unmapped(*control_file, matcher.Records{*r}, keys) {
+				warn(w)
+			}
+		}
+		open := func() (matcher.RecordReader, error) {
+			file, reader := openData(*control_file, controlFormat)
+			return &controlStream{file: file, reader: reader, prepare: prepare}, nil
+		}
+		opti, made, err = m.StreamOptimized(ctx, cases, open)
+		if nil == err && *verbose {
+			controls = streamedControls(open, opti, cases)
+		}
+	} else {
+		opti, made, err = m.QuantityOptimizedContext(ctx, cases, controls.Records)
+	}
+	progress.clear()
+	if nil != ctx.Err() {
+		closeComps()
+		if "" != *checkpointFile {
+			log.Printf("Interrupted, no matches written, carry on with --resume from %s", *checkpointFile)
+		} else {
+			log.Print("Interrupted, no matches written")
+		}
+		os.Exit(130)
+	}
+	if nil != err {
+		log.Fatal(err)
+	}
+	if "" != *checkpointFile {
+		if err := os.Remove(*checkpointFile); nil != err && !os.IsNotExist(err) {
+			log.Printf("Warning: could not remove the finished checkpoint: %s", err)
+		}
+	}
 
 	out := csv.NewWriter(*outFile)
 	sep, err := strconv.Unquote("'" + *outSep + "'")
@@ -101,6 +919,16 @@ func main() {
 	for i := 0; i < *numberMatches; i++ {
 		line = append(line, fmt.Sprintf("control %d", i+1))
 	}
+	if len(tiers) > 1 {
+		for i := 0; i < *numberMatches; i++ {
+			line = append(line, fmt.Sprintf("tier %d", i+1))
+		}
+	}
+	if len(dropped) > 0 {
+		for i := 0; i < *numberMatches; i++ {
+			line = append(line, fmt.Sprintf("keys %d", i+1))
+		}
+	}
 	out.Write(line)
 
 	for _, r := range cases {
@@ -117,12 +945,33 @@ func main() {
 				line = append(line, "")
 			}
 		}
+		if len(tiers) > 1 {
+			for i := 0; i < *numberMatches; i++ {
+				if i < len(m) {
+					line = append(line, strconv.Itoa(made[matcher.NewPair(r.ID, m[i])]+1))
+				} else {
+					line = append(line, "")
+				}
+			}
+		}
+		if len(dropped) > 0 {
+			for i := 0; i < *numberMatches; i++ {
+				if i < len(m) {
+					line = append(line, keyColumns(tiers[made[matcher.NewPair(r.ID, m[i])]], columns))
+				} else {
+					line = append(line, "")
+				}
+			}
+		}
 		if *verbose {
-			for _, p := range positions {
+			for _, p := range keys.Positions() {
 				line = append(line, r.Atts[p].String())
 				for i := 0; i < *numberMatches; i++ {
 					if i < len(m) {
-						control := controls.Get(m[i])
+						control, ok := controls.Get(m[i])
+						if !ok {
+							log.Fatalf("Matched control %s is not in %s", m[i], *control_file)
+						}
 						line = append(line, control.Atts[p].String())
 					} else {
 						line = append(line, "")
@@ -0,0 +1,48 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher
+
+// An Alignment puts the attributes of Records from one file into the column
+// order of another, by the names in their header rows. It holds, for each
+// attribute position of the other file, the position in the first file of
+// the column with the same name, or -1 if it has none or more than one
+type Alignment []int
+
+// NewAlignment returns the Alignment of Records with the header row from to
+// those with the header row to
+func NewAlignment(from, to []string) Alignment {
+	a := make(Alignment, 0, len(to))
+	for i := 1; i < len(to); i++ {
+		a = append(a, -1)
+	}
+	columns := HeaderColumns(from)
+	for n, p := range HeaderColumns(to) {
+		if f, ok := columns[n]; ok && p >= 0 {
+			a[p] = f
+		}
+	}
+	return a
+}
+
+// Apply rearranges the attributes of r to follow the Alignment, those with no
+// column to come from being missing
+func (a Alignment) Apply(r *Record) {
+	atts := make([]Atter, len(a))
+	for i, p := range a {
+		if p >= 0 && p < len(r.Atts) {
+			atts[i] = r.Atts[p]
+		} else {
+			atts[i] = MissingAtt{""}
+		}
+	}
+	r.Atts = atts
+}
+
+// Align rearranges the attributes of every Record in r to follow a
+func (r Records) Align(a Alignment) {
+	for i := range r {
+		a.Apply(&r[i])
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	. "github.com/oklasoft/mmatcher/matcher"
+)
+
+func TestNewAlignment(t *testing.T) {
+	tests := []struct {
+		from, to []string
+		e        Alignment
+	}{
+		{[]string{"id", "sex", "age"}, []string{"id", "sex", "age"}, Alignment{0, 1}},
+		{[]string{"id", "age", "extra", "sex"}, []string{"id", "sex", "age"}, Alignment{2, 0}},
+		{[]string{"id", "age"}, []string{"id", "sex", "age", ""}, Alignment{-1, 0, -1}},
+		{[]string{"id", "sex", "sex", "age"}, []string{"id", "sex", "age"}, Alignment{-1, 2}},
+		{[]string{"id", "sex", "age"}, []string{"id", "sex", "age", "sex"}, Alignment{-1, 1, -1}},
+	}
+	for _, test := range tests {
+		if a := NewAlignment(test.from, test.to); !reflect.DeepEqual(test.e, a) {
+			t.Errorf("Expected aligning %v to %v to give %v, but got %v", test.from, test.to, test.e, a)
+		}
+	}
+}
+
+func TestRecordsAlign(t *testing.T) {
+	cases, caseHeader, err := NewRecordsAndHeaderFromCSV(strings.NewReader("id,sex,age,race\na1,F,40,White"), true)
+	if nil != err {
+		t.Fatal(err)
+	}
+	controls, controlHeader, err := NewRecordsAndHeaderFromCSV(strings.NewReader("id,age,site,sex\nb1,42,OK,F\nb2,40,TX,M"), true)
+	if nil != err {
+		t.Fatal(err)
+	}
+	controls.Align(NewAlignment(controlHeader, caseHeader))
+	e := Records{
+		{ID: "b1", Atts: []Atter{TextAtt{"F"}, NumericAtt{42}, MissingAtt{""}}},
+		{ID: "b2", Atts: []Atter{TextAtt{"M"}, NumericAtt{40}, MissingAtt{""}}},
+	}
+	if !reflect.DeepEqual(e, controls) {
+		t.Errorf("Expected %v, but got %v", e, controls)
+	}
+	keys := Keys{{Position: 0}, {Position: 1, Range: NumericAtt{5}}}
+	if m := cases[0].MatchesOn(controls, keys); !reflect.DeepEqual([]int{0}, m) {
+		t.Error("Expected a1 to match just b1 once aligned, but got", m)
+	}
+}
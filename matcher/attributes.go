@@ -26,24 +26,112 @@ type NumericAtt struct {
 	Val float64
 }
 
-// Equal returns true if strings a & b are in fact equal, e is ignored
+// An AbsAtt is a +/- range for NumericAtt that compares the absolute values of
+// the numbers, so -3 & 3 are the same. For when only the size of a number is
+// meaningful, rather than its sign
+type AbsAtt struct {
+	Val float64
+}
+
+// A MissingAtt stands in for a value that was not recorded for a Record. Val
+// holds the token as it was found in the input, such as "" or "NA"
+type MissingAtt struct {
+	Val string
+}
+
+// Equal returns true if b is also missing, e is ignored. How missing values
+// match for a given column is otherwise up to the MissingPolicy of its Key
+func (a MissingAtt) Equal(b Atter, e Atter) bool {
+	_, ok := b.(MissingAtt)
+	return ok
+}
+
+// IsMissing returns true if a is a MissingAtt
+func IsMissing(a Atter) bool {
+	_, ok := a.(MissingAtt)
+	return ok
+}
+
+// A GeoAtt is a location as latitude & longitude in degrees, compared by the
+// great-circle distance between them in kilometers
+type GeoAtt struct {
+	Lat float64
+	Lon float64
+}
+
+// EarthRadius is the mean radius of the Earth in kilometers
+const EarthRadius = 6371.0088
+
+// Equal returns true if a & b are within e (if e is NumericAtt) kilometers of
+// each other, otherwise only if they are at the same place
+func (a GeoAtt) Equal(b Atter, e Atter) bool {
+	v, ok := b.(GeoAtt)
+	if !ok {
+		return false
+	}
+	if a == v {
+		return true
+	}
+	epsilon, ok := e.(NumericAtt)
+	return ok && a.Distance(v) <= epsilon.Val
+}
+
+// Distance returns the great-circle distance from a to b in kilometers
+func (a GeoAtt) Distance(b GeoAtt) float64 {
+	rad := math.Pi / 180
+	dLat := (b.Lat - a.Lat) * rad
+	dLon := (b.Lon - a.Lon) * rad
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(a.Lat*rad)*math.Cos(b.Lat*rad)*math.Pow(math.Sin(dLon/2), 2)
+	return 2 * EarthRadius * math.Asin(math.Sqrt(math.Min(1, h)))
+}
+
+// Equal returns true if strings a & b are in fact equal. If e is an EquivAtt
+// a & b are equal when in the same class, otherwise e is ignored
 func (a TextAtt) Equal(b Atter, e Atter) bool {
+	if q, ok := e.(EquivAtt); ok {
+		return q.Equal(a, b)
+	}
 	v, ok := b.(TextAtt)
 	return ok && a.Val == v.Val
 }
 
-// Equal returns true if numbers a & b are equal or within e (if e is NumericAtt)
-// If e is not a NumericAtt, just a & b are compared for equality
+// Equal returns true if numbers a & b are equal or their Distance is within e
+// (if e is NumericAtt). If e is an AbsAtt it is the absolute values of a & b
+// that must be within range. If e is an EquivAtt a & b are equal when in the
+// same class. Otherwise just a & b are compared for equality. NaN is never
+// equal to anything, infinities only to the same infinity
 func (a NumericAtt) Equal(b Atter, e Atter) bool {
+	if q, ok := e.(EquivAtt); ok {
+		return q.Equal(a, b)
+	}
 	v, ok := b.(NumericAtt)
-	if !ok {
+	if !ok || math.IsNaN(a.Val) || math.IsNaN(v.Val) {
 		return false
 	}
-	epsilon, ok := e.(NumericAtt)
-	if ok && epsilon.Val > 0 {
-		return math.Abs(math.Abs(a.Val)-math.Abs(v.Val)) <= epsilon.Val
+	if a.Val == v.Val {
+		return true
+	}
+	switch epsilon := e.(type) {
+	case NumericAtt:
+		return a.Distance(v) <= epsilon.Val
+	case AbsAtt:
+		x, y := math.Abs(a.Val), math.Abs(v.Val)
+		return x == y || math.Abs(x-y) <= epsilon.Val
 	}
-	return a.Val == v.Val
+	return false
+}
+
+// Distance returns the absolute difference between a & b, so the distance
+// from -3 to 3 is 6. It is NaN if either is NaN, +Inf if only one is infinite
+// or NaN if both are
+func (a NumericAtt) Distance(b NumericAtt) float64 {
+	return math.Abs(a.Val - b.Val)
+}
+
+// Equal returns true if a & b are NumericAtt with absolute values within e
+func (e AbsAtt) Equal(a Atter, b Atter) bool {
+	n, ok := a.(NumericAtt)
+	return ok && n.Equal(b, e)
 }
 
 func (a NumericAtt) String() string {
@@ -53,3 +141,15 @@ func (a NumericAtt) String() string {
 func (a TextAtt) String() string {
 	return a.Val
 }
+
+func (a MissingAtt) String() string {
+	return a.Val
+}
+
+func (e AbsAtt) String() string {
+	return fmt.Sprintf("abs %v", e.Val)
+}
+
+func (a GeoAtt) String() string {
+	return fmt.Sprintf("%v %v", a.Lat, a.Lon)
+}
@@ -5,8 +5,10 @@
 package matcher_test
 
 import (
-	. "github.com/oklasoft/mmatcher/matcher"
+	"math"
 	"testing"
+
+	. "github.com/oklasoft/mmatcher/matcher"
 )
 
 func TestTextAttsEqual(t *testing.T) {
@@ -60,3 +62,116 @@ func TestNumericAttsEqual(t *testing.T) {
 		t.Error("%s should not equal %s with epsilon %s", n1, n2, e)
 	}
 }
+
+func TestMissingAttsEqual(t *testing.T) {
+	m := MissingAtt{""}
+	na := MissingAtt{"NA"}
+	if !m.Equal(na, nil) {
+		t.Errorf("%q expected to equal %q as both are missing", m, na)
+	}
+	if m.Equal(TextAtt{""}, nil) {
+		t.Error("MissingAtt should not equal an empty TextAtt")
+	}
+	if (TextAtt{""}).Equal(m, nil) {
+		t.Error("Empty TextAtt should not equal a MissingAtt")
+	}
+	if (NumericAtt{0}).Equal(m, NumericAtt{10}) {
+		t.Error("NumericAtt should not equal a MissingAtt even with a range")
+	}
+	if !IsMissing(na) || IsMissing(TextAtt{"NA"}) {
+		t.Error("Only a MissingAtt is expected to be missing")
+	}
+	if "NA" != na.String() {
+		t.Error("MissingAtt expected to keep its original token, but was", na)
+	}
+}
+
+func TestNumericAttsSigned(t *testing.T) {
+	tests := []struct {
+		a, b     float64
+		e        Atter
+		expected bool
+	}{
+		{-3, 3, NumericAtt{}, false},
+		{-3, 3, NumericAtt{5}, false},
+		{-3, 3, NumericAtt{6}, true},
+		{-1.5, -2, NumericAtt{0.5}, true},
+		{-1.5, 2, NumericAtt{0.5}, false},
+		{-3, 3, AbsAtt{}, true},
+		{-3, 3.5, AbsAtt{0.5}, true},
+		{-3, 4, AbsAtt{0.5}, false},
+		{math.NaN(), math.NaN(), nil, false},
+		{math.NaN(), math.NaN(), NumericAtt{10}, false},
+		{math.NaN(), 1, NumericAtt{math.Inf(1)}, false},
+		{math.Inf(1), math.Inf(1), nil, true},
+		{math.Inf(1), math.Inf(1), NumericAtt{1}, true},
+		{math.Inf(1), math.Inf(-1), NumericAtt{1}, false},
+		{math.Inf(1), math.Inf(-1), AbsAtt{}, true},
+		{math.Inf(-1), -1e300, NumericAtt{1e300}, false},
+		{5, 1e300, NumericAtt{math.Inf(1)}, true},
+	}
+	for _, test := range tests {
+		a, b := NumericAtt{test.a}, NumericAtt{test.b}
+		if test.expected != a.Equal(b, test.e) {
+			t.Errorf("Expected %v equal %v with %v to be %v", a, b, test.e, test.expected)
+		}
+		if a.Equal(b, test.e) != b.Equal(a, test.e) {
+			t.Errorf("Expected %v equal %v with %v to be the same both ways", a, b, test.e)
+		}
+	}
+	if e := (AbsAtt{1}); !e.Equal(NumericAtt{-2}, NumericAtt{3}) || e.Equal(TextAtt{"2"}, NumericAtt{2}) {
+		t.Errorf("Expected %v to compare only numbers by absolute value", e)
+	}
+}
+
+func TestNumericAttsDistance(t *testing.T) {
+	tests := []struct {
+		a, b, d float64
+	}{
+		{-3, 3, 6},
+		{3, -3, 6},
+		{-5, -2, 3},
+		{1.5, 1.5, 0},
+		{math.Inf(1), 0, math.Inf(1)},
+	}
+	for _, test := range tests {
+		if d := (NumericAtt{test.a}).Distance(NumericAtt{test.b}); test.d != d {
+			t.Errorf("Expected distance from %v to %v to be %v, but was %v", test.a, test.b, test.d, d)
+		}
+	}
+	if d := (NumericAtt{math.NaN()}).Distance(NumericAtt{1}); !math.IsNaN(d) {
+		t.Error("Expected NaN distance with NaN, but was", d)
+	}
+	if d := (NumericAtt{math.Inf(1)}).Distance(NumericAtt{math.Inf(1)}); !math.IsNaN(d) {
+		t.Error("Expected NaN distance between infinities, but was", d)
+	}
+}
+
+func TestGeoAttsEqual(t *testing.T) {
+	okc := GeoAtt{35.4676, -97.5164}
+	tulsa := GeoAtt{36.1540, -95.9928}
+	if d := okc.Distance(tulsa); d < 155 || d > 160 {
+		t.Errorf("Expected %v to be about 158km from %v, but was %v", okc, tulsa, d)
+	}
+	if d := okc.Distance(okc); 0 != d {
+		t.Error("Expected no distance from a place to itself, but was", d)
+	}
+	if d := (GeoAtt{0, 179.5}).Distance(GeoAtt{0, -179.5}); d < 110 || d > 112 {
+		t.Error("Expected about 111km across the antimeridian, but was", d)
+	}
+	if !okc.Equal(okc, nil) {
+		t.Errorf("%v expected to equal itself", okc)
+	}
+	if okc.Equal(tulsa, nil) {
+		t.Errorf("%v should not equal %v without a range", okc, tulsa)
+	}
+	if !okc.Equal(tulsa, NumericAtt{160}) {
+		t.Errorf("%v should equal %v within 160km", okc, tulsa)
+	}
+	if tulsa.Equal(okc, NumericAtt{150}) {
+		t.Errorf("%v should not equal %v within 150km", tulsa, okc)
+	}
+	if okc.Equal(NumericAtt{35.4676}, NumericAtt{1000}) {
+		t.Error("GeoAtt should not equal a NumericAtt")
+	}
+}
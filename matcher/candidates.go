@@ -0,0 +1,201 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// streamBatch is how many controls StreamCandidates reads before sharing them
+// out between its workers
+const streamBatch = 4096
+
+// Candidates returns a MatchSet pairing each of the cases with every one of
+// the controls it matches on Criterion c. The controls are first put into an
+// Index, so cases are only checked against the controls they could match
+func Candidates(cases, controls Records, c Criterion) MatchSet {
+	return ParallelCandidates(cases, controls, c, 1)
+}
+
+// ParallelCandidates is Candidates with the cases split between jobs workers,
+// or one per CPU if jobs is 0 or less. The pairs are added in the same order
+// as Candidates would, so the resulting MatchSet is identical
+func ParallelCandidates(cases, controls Records, c Criterion, jobs int) MatchSet {
+	m, _ := PrunedCandidates(cases, controls, c, Pruning{}, jobs)
+	return m
+}
+
+// PrunedCandidates is ParallelCandidates keeping only the candidates for each
+// case allowed by p. It also returns how many candidate pairs were pruned
+func PrunedCandidates(cases, controls Records, c Criterion, p Pruning, jobs int) (MatchSet, int) {
+	m, pruned, _ := prunedCandidates(context.Background(), cases, controls, c, p, jobs, nil)
+	return m, pruned
+}
+
+// prunedCandidates is PrunedCandidates stopping early with the error once ctx
+// is done. scanned, if set, is called with the number of candidates found for
+// each case once it is checked
+func prunedCandidates(ctx context.Context, cases, controls Records, c Criterion, p Pruning, jobs int, scanned func(found int)) (MatchSet, int, error) {
+	x := NewIndex(controls, c)
+	found := make([][]candidate, len(cases))
+	pruned := make([]int, len(cases))
+	err := parallel(ctx, len(cases), jobs, func(i int) {
+		k := newPruner(p, cases[i].ID)
+		for _, j := range x.Matches(&cases[i]) {
+			d := 0.0
+			if p.Keep > 0 && !p.Random {
+				d = Distance(c, &cases[i], &controls[j])
+			}
+			k.add(candidate{order: j, id: controls[j].ID, distance: d})
+		}
+		if nil != scanned {
+			scanned(k.found)
+		}
+		found[i], pruned[i] = k.candidates()
+	})
+	if nil != err {
+		return NewMatchSet(), 0, err
+	}
+	return pairCandidates(cases, found), sum(pruned), nil
+}
+
+// StreamCandidates is PrunedCandidates for controls read one at a time from
+// in, so they never all have to be held in memory. The cases are put into an
+// Index instead, each control being checked against the cases it could match
+// & then dropped, keeping only the IDs of those it matched. The resulting
+// MatchSet is identical to that of PrunedCandidates. Reading stops with the
+// error once ctx is done
+func StreamCandidates(ctx context.Context, cases Records, in RecordReader, c Criterion, p Pruning, jobs int) (MatchSet, int, error) {
+	return streamCandidates(ctx, cases, in, c, p, jobs, nil)
+}
+
+// streamCandidates is StreamCandidates calling scanned, if set, with the
+// number of cases matched by each control once it is checked
+func streamCandidates(ctx context.Context, cases Records, in RecordReader, c Criterion, p Pruning, jobs int, scanned func(found int)) (MatchSet, int, error) {
+	x := NewIndex(cases, c)
+	kept := make([]*pruner, len(cases))
+	for i := range cases {
+		kept[i] = newPruner(p, cases[i].ID)
+	}
+	read := 0
+	batch := make(Records, 0, streamBatch)
+	matched := make([][]int, streamBatch)
+	distances := make([][]float64, streamBatch)
+	flush := func() error {
+		err := parallel(ctx, len(batch), jobs, func(i int) {
+			matched[i] = x.MatchedBy(&batch[i])
+			distances[i] = distances[i][:0]
+			if p.Keep > 0 && !p.Random {
+				for _, j := range matched[i] {
+					distances[i] = append(distances[i], Distance(c, &cases[j], &batch[i]))
+				}
+			}
+		})
+		if nil != err {
+			return err
+		}
+		for i := range batch {
+			if nil != scanned {
+				scanned(len(matched[i]))
+			}
+			for n, j := range matched[i] {
+				d := 0.0
+				if n < len(distances[i]) {
+					d = distances[i][n]
+				}
+				kept[j].add(candidate{order: read + i, id: batch[i].ID, distance: d})
+			}
+		}
+		read += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	for {
+		r, err := in.Read()
+		if io.EOF == err {
+			break
+		} else if nil != err {
+			return NewMatchSet(), 0, err
+		}
+		batch = append(batch, r)
+		if streamBatch == len(batch) {
+			if err := flush(); nil != err {
+				return NewMatchSet(), 0, err
+			}
+		}
+	}
+	if err := flush(); nil != err {
+		return NewMatchSet(), 0, err
+	}
+
+	found := make([][]candidate, len(cases))
+	pruned := make([]int, len(cases))
+	for i, k := range kept {
+		found[i], pruned[i] = k.candidates()
+	}
+	return pairCandidates(cases, found), sum(pruned), nil
+}
+
+// pairCandidates returns a MatchSet pairing each of the cases with its found
+// candidates, in order
+func pairCandidates(cases Records, found [][]candidate) MatchSet {
+	m := NewMatchSet()
+	for i, f := range found {
+		for _, c := range f {
+			m.AddPair(NewPair(cases[i].ID, c.id))
+		}
+	}
+	return m
+}
+
+func sum(n []int) (s int) {
+	for _, v := range n {
+		s += v
+	}
+	return s
+}
+
+// parallel calls f for each of 0 to n-1 using jobs workers, or one per CPU if
+// jobs is 0 or less, returning once all are done. Once ctx is done no more
+// calls are started & its error is returned
+func parallel(ctx context.Context, n, jobs int, f func(i int)) error {
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+	if jobs <= 1 {
+		for i := 0; i < n; i++ {
+			if err := ctx.Err(); nil != err {
+				return err
+			}
+			f(i)
+		}
+		return ctx.Err()
+	}
+	next := make(chan int, jobs)
+	var wg sync.WaitGroup
+	for j := 0; j < jobs; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				f(i)
+			}
+		}()
+	}
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+	return ctx.Err()
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	. "github.com/oklasoft/mmatcher/matcher"
+)
+
+func TestCandidates(t *testing.T) {
+	a := Records{
+		Record{ID: "a1", Atts: []Atter{TextAtt{"red"}, NumericAtt{20}}},
+		Record{ID: "a2", Atts: []Atter{TextAtt{"green"}, NumericAtt{30}}},
+	}
+	b := Records{
+		Record{ID: "b1", Atts: []Atter{TextAtt{"red"}, NumericAtt{22}}},
+		Record{ID: "b2", Atts: []Atter{TextAtt{"red"}, NumericAtt{35}}},
+		Record{ID: "b3", Atts: []Atter{TextAtt{"green"}, NumericAtt{29}}},
+	}
+	m := Candidates(a, b, Keys{{Position: 0}, {Position: 1, Range: NumericAtt{5}}})
+	if 2 != m.NumPairs() {
+		t.Error("Expected 2 candidate pairs, but got", m)
+	}
+	if o := m.MatchesFor("a1"); 1 != len(o) || "b1" != o[0] {
+		t.Error("Expected a1 to have only b1 as a candidate, but got", o)
+	}
+}
+
+func TestParallelCandidates(t *testing.T) {
+	rng := rand.New(rand.NewSource(37))
+	cases := randomRecords(rng, "a", 300)
+	controls := randomRecords(rng, "b", 1000)
+	k := Keys{{Position: 0}, {Position: 2, Range: NumericAtt{5}}}
+	expected := Candidates(cases, controls, k)
+	for _, jobs := range []int{0, 2, 7} {
+		m := ParallelCandidates(cases, controls, k, jobs)
+		if expected.NumPairs() != m.NumPairs() {
+			t.Errorf("Expected %d candidates with %d jobs, but got %d", expected.NumPairs(), jobs, m.NumPairs())
+		}
+		for _, r := range append(cases, controls...) {
+			if e, o := expected.MatchesFor(r.ID), m.MatchesFor(r.ID); !reflect.DeepEqual(e, o) {
+				t.Errorf("Expected %s to have candidates %v with %d jobs, but got %v", r.ID, e, jobs, o)
+			}
+		}
+		eo, o := expected.QuantityOptimized(2), m.QuantityOptimized(2)
+		for _, r := range cases {
+			if e, o := eo.MatchesFor(r.ID), o.MatchesFor(r.ID); !reflect.DeepEqual(e, o) {
+				t.Errorf("Expected %s to be optimized to %v with %d jobs, but got %v", r.ID, e, jobs, o)
+			}
+		}
+	}
+}
+
+// A recordsReader reads Records from a slice, then err or io.EOF at the end
+type recordsReader struct {
+	r   Records
+	err error
+}
+
+func (x *recordsReader) Read() (Record, error) {
+	if 0 == len(x.r) {
+		if nil != x.err {
+			return Record{}, x.err
+		}
+		return Record{}, io.EOF
+	}
+	r := x.r[0]
+	x.r = x.r[1:]
+	return r, nil
+}
+
+func TestStreamCandidates(t *testing.T) {
+	rng := rand.New(rand.NewSource(41))
+	cases := randomRecords(rng, "a", 200)
+	controls := randomRecords(rng, "b", 9000)
+	older, err := ParseRule("b.3 >= a.3", nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	tests := []Criterion{
+		Keys{{Position: 0}, {Position: 2, Range: NumericAtt{5}}},
+		Criteria{Keys{{Position: 1}, {Position: 3, Range: NumericAtt{0.5}}}, older},
+	}
+	for n, c := range tests {
+		expected := Candidates(cases, controls, c)
+		for _, jobs := range []int{1, 3} {
+			m, _, err := StreamCandidates(context.Background(), cases, &recordsReader{r: controls}, c, Pruning{}, jobs)
+			if nil != err {
+				t.Fatal("Expected no error streaming candidates, but got", err)
+			}
+			if expected.NumPairs() != m.NumPairs() {
+				t.Errorf("Expected %d candidates for %d with %d jobs, but got %d", expected.NumPairs(), n, jobs, m.NumPairs())
+			}
+			for _, r := range cases {
+				if e, o := expected.MatchesFor(r.ID), m.MatchesFor(r.ID); !reflect.DeepEqual(e, o) {
+					t.Errorf("Expected %s to have candidates %v for %d with %d jobs, but got %v", r.ID, e, n, jobs, o)
+				}
+			}
+		}
+	}
+
+	bad := errors.New("bad row")
+	if _, _, err := StreamCandidates(context.Background(), cases, &recordsReader{r: controls[:10], err: bad}, tests[0], Pruning{}, 1); bad != err {
+		t.Error("Expected the error from reading the controls, but got", err)
+	}
+}
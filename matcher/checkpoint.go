@@ -0,0 +1,136 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+// checkpointVersion is the version of the checkpoint format written, older
+// or newer versions cannot be read
+const checkpointVersion = 1
+
+// A Checkpoint is the state of a Matcher part way through, from which it can
+// carry on with Resume. Tiers before Tier are done, with their pairs in
+// Matched. Once the candidates for Tier are found they are kept too, along
+// with each of their connected components already optimized
+type Checkpoint struct {
+	Inputs     string           // Identifies the inputs, for the caller to check on resuming
+	Tier       int              // Index of the tier in progress
+	Matched    MatchSet         // Pairs made in the tiers before
+	Made       map[Pair]int     // Index of the tier each of the Matched pairs was made at
+	Found      bool             // True once the Candidates for Tier are found
+	Candidates MatchSet         // Candidate pairs for Tier
+	Pruned     int              // Candidate pairs pruned for Tier
+	Optimized  map[int]MatchSet // Components of Candidates optimized, by index
+}
+
+// checkpointData is a Checkpoint as written
+type checkpointData struct {
+	Version    int
+	Inputs     string
+	Tier       int
+	Matched    matchSetData
+	Made       []madePair
+	Found      bool
+	Candidates matchSetData
+	Pruned     int
+	Optimized  map[int]matchSetData
+}
+
+// matchSetData is a MatchSet as written, kept exactly as it is so the order of
+// pairs is the same when read
+type matchSetData struct {
+	IDs []string
+	IsA []bool
+	Adj [][]int32
+}
+
+type madePair struct {
+	A, B string
+	Tier int
+}
+
+func newMatchSetData(m MatchSet) matchSetData {
+	if nil == m.items {
+		return matchSetData{}
+	}
+	return matchSetData{IDs: m.ids, IsA: m.isA, Adj: m.adj}
+}
+
+func (d matchSetData) matchSet() (MatchSet, error) {
+	m := NewMatchSet()
+	if len(d.IsA) != len(d.IDs) || len(d.Adj) != len(d.IDs) {
+		return m, fmt.Errorf("checkpoint has a malformed set of pairs")
+	}
+	m.ids, m.isA, m.adj = d.IDs, d.IsA, d.Adj
+	for i, id := range m.ids {
+		m.index[id] = int32(i)
+		for _, p := range m.adj[i] {
+			if p < 0 || int(p) >= len(m.ids) {
+				return m, fmt.Errorf("checkpoint has a malformed set of pairs")
+			}
+		}
+	}
+	return m, nil
+}
+
+// Write writes the Checkpoint to w
+func (c *Checkpoint) Write(w io.Writer) error {
+	d := checkpointData{
+		Version:    checkpointVersion,
+		Inputs:     c.Inputs,
+		Tier:       c.Tier,
+		Matched:    newMatchSetData(c.Matched),
+		Found:      c.Found,
+		Candidates: newMatchSetData(c.Candidates),
+		Pruned:     c.Pruned,
+		Optimized:  make(map[int]matchSetData, len(c.Optimized)),
+	}
+	for p, t := range c.Made {
+		d.Made = append(d.Made, madePair{A: p.a, B: p.b, Tier: t})
+	}
+	for i, o := range c.Optimized {
+		d.Optimized[i] = newMatchSetData(o)
+	}
+	return gob.NewEncoder(w).Encode(d)
+}
+
+// ReadCheckpoint reads a Checkpoint written by Checkpoint.Write from r
+func ReadCheckpoint(r io.Reader) (*Checkpoint, error) {
+	var d checkpointData
+	if err := gob.NewDecoder(r).Decode(&d); nil != err {
+		return nil, fmt.Errorf("reading checkpoint: %s", err)
+	}
+	if checkpointVersion != d.Version {
+		return nil, fmt.Errorf("checkpoint is version %d, not %d", d.Version, checkpointVersion)
+	}
+	c := &Checkpoint{
+		Inputs:    d.Inputs,
+		Tier:      d.Tier,
+		Made:      make(map[Pair]int, len(d.Made)),
+		Found:     d.Found,
+		Pruned:    d.Pruned,
+		Optimized: make(map[int]MatchSet, len(d.Optimized)),
+	}
+	var err error
+	if c.Matched, err = d.Matched.matchSet(); nil != err {
+		return nil, err
+	}
+	if c.Candidates, err = d.Candidates.matchSet(); nil != err {
+		return nil, err
+	}
+	for _, p := range d.Made {
+		c.Made[NewPair(p.A, p.B)] = p.Tier
+	}
+	for i, o := range d.Optimized {
+		if c.Optimized[i], err = o.matchSet(); nil != err {
+			return nil, err
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher_test
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	. "github.com/oklasoft/mmatcher/matcher"
+)
+
+func TestCheckpointWriteRead(t *testing.T) {
+	m := NewMatchSet()
+	m.AddPair(NewPair("a1", "b2"))
+	m.AddPair(NewPair("a1", "b1"))
+	m.AddPair(NewPair("a2", "b1"))
+	o := NewMatchSet()
+	o.AddPair(NewPair("a2", "b1"))
+	c := &Checkpoint{
+		Inputs:     "abc",
+		Tier:       1,
+		Matched:    o,
+		Made:       map[Pair]int{NewPair("a2", "b1"): 0},
+		Found:      true,
+		Candidates: m,
+		Pruned:     3,
+		Optimized:  map[int]MatchSet{0: o},
+	}
+	var buf bytes.Buffer
+	if err := c.Write(&buf); nil != err {
+		t.Fatal("Expected no error writing a checkpoint, but got", err)
+	}
+	r, err := ReadCheckpoint(&buf)
+	if nil != err {
+		t.Fatal("Expected no error reading a checkpoint, but got", err)
+	}
+	if c.Inputs != r.Inputs || c.Tier != r.Tier || c.Found != r.Found || c.Pruned != r.Pruned {
+		t.Errorf("Expected %+v back, but got %+v", c, r)
+	}
+	if !reflect.DeepEqual(c.Made, r.Made) {
+		t.Errorf("Expected made pairs %v back, but got %v", c.Made, r.Made)
+	}
+	for _, id := range []string{"a1", "a2", "b1", "b2"} {
+		if e, g := m.MatchesFor(id), r.Candidates.MatchesFor(id); !reflect.DeepEqual(e, g) {
+			t.Errorf("Expected %s to have candidates %v in order, but got %v", id, e, g)
+		}
+	}
+	ro := r.Optimized[0]
+	if e, g := o.MatchesFor("a2"), ro.MatchesFor("a2"); 1 != len(r.Optimized) || !reflect.DeepEqual(e, g) {
+		t.Errorf("Expected optimized component %v back, but got %v", o, r.Optimized)
+	}
+	if 1 != r.Matched.NumPairs() {
+		t.Error("Expected one matched pair back, but got", r.Matched)
+	}
+
+	empty := &Checkpoint{}
+	buf.Reset()
+	if err := empty.Write(&buf); nil != err {
+		t.Fatal("Expected no error writing an empty checkpoint, but got", err)
+	}
+	if r, err := ReadCheckpoint(&buf); nil != err || 0 != r.Matched.NumPairs() {
+		t.Errorf("Expected an empty checkpoint back, but got %v & %v", r, err)
+	}
+	if _, err := ReadCheckpoint(strings.NewReader("not a checkpoint")); nil == err {
+		t.Error("Expected an error reading something else")
+	}
+}
+
+func TestMatcherResume(t *testing.T) {
+	rng := rand.New(rand.NewSource(71))
+	cases := randomRecords(rng, "a", 150)
+	controls := randomRecords(rng, "b", 500)
+	m := Matcher{
+		Tiers: Tiers{
+			Keys{{Position: 0}, {Position: 2, Range: NumericAtt{1}}},
+			Keys{{Position: 0}, {Position: 2, Range: NumericAtt{4}}},
+			Keys{{Position: 2, Range: NumericAtt{4}}},
+		},
+		Allowed: 2,
+		Jobs:    1,
+	}
+	expected, expectedMade := m.QuantityOptimized(cases, controls)
+
+	saved := [][]byte{}
+	m.Checkpoint = func(c *Checkpoint) error {
+		var buf bytes.Buffer
+		err := c.Write(&buf)
+		saved = append(saved, buf.Bytes())
+		return err
+	}
+	if _, _, err := m.QuantityOptimizedContext(context.Background(), cases, controls); nil != err {
+		t.Fatal("Expected no error checkpointing, but got", err)
+	}
+	if len(saved) < 6 {
+		t.Fatal("Expected a checkpoint at each tier & component, but got", len(saved))
+	}
+
+	// stopping part way through leaves a last checkpoint
+	ctx, cancel := context.WithCancel(context.Background())
+	m.Progress = func(p Progress) {
+		if 1 == p.Tier && p.Scanned >= 5 {
+			cancel()
+		}
+	}
+	var last []byte
+	m.Checkpoint = func(c *Checkpoint) error {
+		var buf bytes.Buffer
+		err := c.Write(&buf)
+		last = buf.Bytes()
+		return err
+	}
+	if _, _, err := m.QuantityOptimizedContext(ctx, cases, controls); context.Canceled != err {
+		t.Fatal("Expected to be cancelled, but got", err)
+	}
+	saved = append(saved, last)
+	m.Progress = nil
+	m.Checkpoint = nil
+
+	for i, b := range saved {
+		c, err := ReadCheckpoint(bytes.NewReader(b))
+		if nil != err {
+			t.Fatal("Expected to read checkpoint", i, "but got", err)
+		}
+		m.Resume = c
+		o, made, err := m.QuantityOptimizedContext(context.Background(), cases, controls)
+		if nil != err {
+			t.Fatal("Expected no error resuming, but got", err)
+		}
+		if !reflect.DeepEqual(expectedMade, made) {
+			t.Errorf("Expected resuming from checkpoint %d at tier %d to make the same pairs", i, c.Tier)
+		}
+		for _, r := range cases {
+			if e, g := expected.MatchesFor(r.ID), o.MatchesFor(r.ID); !reflect.DeepEqual(e, g) {
+				t.Errorf("Expected %s to be matched to %v resuming from checkpoint %d, but got %v", r.ID, e, i, g)
+			}
+		}
+	}
+
+	m.Resume = &Checkpoint{Tier: 5}
+	if _, _, err := m.QuantityOptimizedContext(context.Background(), cases, controls); nil == err {
+		t.Error("Expected an error resuming past the last tier")
+	}
+}
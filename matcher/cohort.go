@@ -0,0 +1,233 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// A Distribution is how the values of a generated Column are drawn
+type Distribution int
+
+const (
+	// Normal draws numbers with the Mean & SD of the Column
+	Normal Distribution = iota
+	// Uniform draws numbers evenly between the Min & Max of the Column
+	Uniform
+	// Category draws one of the whole numbers 1 to Levels of the Column
+	Category
+)
+
+var distributionNames = map[Distribution]string{
+	Normal:   "normal",
+	Uniform:  "uniform",
+	Category: "category",
+}
+
+func (d Distribution) String() string {
+	if s, ok := distributionNames[d]; ok {
+		return s
+	}
+	return fmt.Sprintf("Distribution(%d)", int(d))
+}
+
+// A Column describes one attribute of the Records in a synthetic Cohort
+type Column struct {
+	Name     string
+	Dist     Distribution
+	Mean, SD float64 // For Normal
+	Min, Max float64 // For Uniform
+	Levels   int     // For Category
+	Decimals int     // Places numbers are rounded to
+	Missing  float64 // Fraction of values left missing
+	Jitter   float64 // Most a near control differs from its case, +/-
+}
+
+// draw returns a new value for the column
+func (c Column) draw(rng *rand.Rand) float64 {
+	switch c.Dist {
+	case Uniform:
+		return c.Min + rng.Float64()*(c.Max-c.Min)
+	case Category:
+		return float64(1 + rng.Intn(c.Levels))
+	}
+	return c.Mean + rng.NormFloat64()*c.SD
+}
+
+// att turns v into an attribute, missing for the Missing fraction of values
+func (c Column) att(rng *rand.Rand, v float64) Atter {
+	if c.Missing > 0 && rng.Float64() < c.Missing {
+		return MissingAtt{""}
+	}
+	scale := math.Pow(10, float64(c.Decimals))
+	return NumericAtt{math.Round(v*scale) / scale}
+}
+
+// A Cohort describes synthetic cases & controls to Generate, for testing &
+// benchmarking without real data. Density says how many of the controls are
+// near copies of a case, each drawn as a random case with every numeric value
+// moved by up to the Jitter of its Column, with the rest drawn independently
+// from the Columns like the cases. So a higher Density gives more candidates
+type Cohort struct {
+	Cases    int
+	Controls int
+	Columns  []Column
+	Density  float64
+	Seed     int64
+}
+
+// Generate returns the cases & controls of the Cohort, IDs starting case1 &
+// control1. The same Seed always gives the same Records
+func (c Cohort) Generate() (cases, controls Records) {
+	rng := rand.New(rand.NewSource(c.Seed))
+	values := make([][]float64, c.Cases)
+	cases = make(Records, c.Cases)
+	for i := range cases {
+		values[i] = make([]float64, len(c.Columns))
+		atts := make([]Atter, len(c.Columns))
+		for j, col := range c.Columns {
+			values[i][j] = col.draw(rng)
+			atts[j] = col.att(rng, values[i][j])
+		}
+		cases[i] = Record{ID: fmt.Sprintf("case%d", i+1), Atts: atts}
+	}
+	controls = make(Records, c.Controls)
+	for i := range controls {
+		var near []float64
+		if c.Cases > 0 && rng.Float64() < c.Density {
+			near = values[rng.Intn(c.Cases)]
+		}
+		atts := make([]Atter, len(c.Columns))
+		for j, col := range c.Columns {
+			var v float64
+			switch {
+			case nil == near:
+				v = col.draw(rng)
+			case Category == col.Dist:
+				v = near[j]
+			default:
+				v = near[j] + (2*rng.Float64()-1)*col.Jitter
+			}
+			atts[j] = col.att(rng, v)
+		}
+		controls[i] = Record{ID: fmt.Sprintf("control%d", i+1), Atts: atts}
+	}
+	return cases, controls
+}
+
+// Header returns a header row for the Records of the Cohort, id followed by
+// the Column names
+func (c Cohort) Header() []string {
+	h := []string{"id"}
+	for _, col := range c.Columns {
+		h = append(h, col.Name)
+	}
+	return h
+}
+
+// ParseColumns parses a comma separated list of Column specs. Each is a name,
+// a distribution & its parameters, all : separated, as name:normal:MEAN:SD,
+// name:uniform:MIN:MAX or name:category:LEVELS. They can be followed by any
+// of the options decimals=N, missing=FRACTION & jitter=N
+func ParseColumns(s string) ([]Column, error) {
+	var cols []Column
+	for _, spec := range strings.Split(s, ",") {
+		c, err := parseColumnSpec(spec)
+		if nil != err {
+			return nil, fmt.Errorf("column %q: %s", spec, err)
+		}
+		cols = append(cols, c)
+	}
+	return cols, nil
+}
+
+func parseColumnSpec(spec string) (c Column, err error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || "" == parts[0] {
+		return c, fmt.Errorf("needs a name & a distribution")
+	}
+	c.Name = parts[0]
+	params := []*float64{}
+	switch parts[1] {
+	case "normal":
+		c.Dist = Normal
+		params = []*float64{&c.Mean, &c.SD}
+	case "uniform":
+		c.Dist = Uniform
+		params = []*float64{&c.Min, &c.Max}
+	case "category":
+		c.Dist = Category
+	default:
+		return c, fmt.Errorf("unknown distribution %s", parts[1])
+	}
+	rest := parts[2:]
+	if Category == c.Dist {
+		if 0 == len(rest) {
+			return c, fmt.Errorf("needs a number of levels")
+		}
+		if c.Levels, err = strconv.Atoi(rest[0]); nil != err || c.Levels < 1 {
+			return c, fmt.Errorf("invalid number of levels %s", rest[0])
+		}
+		rest = rest[1:]
+	}
+	if len(rest) < len(params) {
+		return c, fmt.Errorf("needs %d parameters for %s", len(params), c.Dist)
+	}
+	for i, p := range params {
+		if *p, err = strconv.ParseFloat(rest[i], 64); nil != err {
+			return c, err
+		}
+	}
+	for _, o := range rest[len(params):] {
+		kv := strings.SplitN(o, "=", 2)
+		if 2 != len(kv) {
+			return c, fmt.Errorf("unexpected %s", o)
+		}
+		switch kv[0] {
+		case "decimals":
+			c.Decimals, err = strconv.Atoi(kv[1])
+		case "missing":
+			c.Missing, err = strconv.ParseFloat(kv[1], 64)
+			if nil == err && (c.Missing < 0 || c.Missing > 1) {
+				err = fmt.Errorf("missing must be a fraction from 0 to 1")
+			}
+		case "jitter":
+			c.Jitter, err = strconv.ParseFloat(kv[1], 64)
+		default:
+			err = fmt.Errorf("unknown option %s", kv[0])
+		}
+		if nil != err {
+			return c, err
+		}
+	}
+	if c.SD < 0 || c.Max < c.Min || c.Decimals < 0 || c.Jitter < 0 {
+		return c, fmt.Errorf("parameters out of range")
+	}
+	return c, nil
+}
+
+// WriteCSV writes r to w as CSV that a Reader reads back the same, after the
+// header row if there is one
+func WriteCSV(w io.Writer, header []string, r Records) error {
+	out := csv.NewWriter(w)
+	if len(header) > 0 {
+		out.Write(header)
+	}
+	for _, rec := range r {
+		line := []string{rec.ID}
+		for _, a := range rec.Atts {
+			line = append(line, a.String())
+		}
+		out.Write(line)
+	}
+	out.Flush()
+	return out.Error()
+}
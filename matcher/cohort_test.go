@@ -0,0 +1,156 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	. "github.com/oklasoft/mmatcher/matcher"
+)
+
+// benchCohort is a cohort with some loose & some exact keys, where about one
+// control in ten is a near copy of a case
+func benchCohort(cases, controls int) Cohort {
+	cols, err := ParseColumns("sex:category:2,age:normal:50:15:jitter=3,race:category:5,bmi:uniform:18:40:decimals=1:jitter=2:missing=0.02")
+	if nil != err {
+		panic(err)
+	}
+	return Cohort{Cases: cases, Controls: controls, Columns: cols, Density: 0.1, Seed: 1}
+}
+
+var benchKeys = Keys{
+	{Position: 0},
+	{Position: 1, Range: NumericAtt{5}},
+	{Position: 2},
+	{Position: 3, Range: NumericAtt{3}},
+}
+
+func TestParseColumns(t *testing.T) {
+	cols, err := ParseColumns("sex:category:2,age:normal:50:15:jitter=3,bmi:uniform:18:40:decimals=1:missing=0.1")
+	if nil != err {
+		t.Fatal(err)
+	}
+	e := []Column{
+		{Name: "sex", Dist: Category, Levels: 2},
+		{Name: "age", Dist: Normal, Mean: 50, SD: 15, Jitter: 3},
+		{Name: "bmi", Dist: Uniform, Min: 18, Max: 40, Decimals: 1, Missing: 0.1},
+	}
+	if !reflect.DeepEqual(e, cols) {
+		t.Errorf("Expected %v, but got %v", e, cols)
+	}
+
+	for _, bad := range []string{
+		"",
+		"age",
+		"age:poisson:3",
+		"age:normal:50",
+		"age:normal:fifty:15",
+		"sex:category",
+		"sex:category:0",
+		"bmi:uniform:40:18",
+		"age:normal:50:15:missing=2",
+		"age:normal:50:15:color=red",
+		"age:normal:50:15:7",
+	} {
+		if _, err := ParseColumns(bad); nil == err {
+			t.Errorf("Expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestCohortGenerate(t *testing.T) {
+	c := benchCohort(100, 1000)
+	cases, controls := c.Generate()
+	if 100 != len(cases) || 1000 != len(controls) {
+		t.Fatalf("Expected 100 cases & 1000 controls, but got %d & %d", len(cases), len(controls))
+	}
+	if "case1" != cases[0].ID || "control1000" != controls[999].ID {
+		t.Errorf("Expected IDs from case1 & control1, but got %s & %s", cases[0].ID, controls[999].ID)
+	}
+	for _, r := range append(cases, controls...) {
+		if 4 != len(r.Atts) {
+			t.Fatalf("Expected 4 attributes, but %s has %v", r.ID, r.Atts)
+		}
+		if s := r.Atts[0].(NumericAtt).Val; 1 != s && 2 != s {
+			t.Errorf("Expected sex of 1 or 2, but %s has %v", r.ID, s)
+		}
+		if b, ok := r.Atts[3].(NumericAtt); ok && (b.Val < 16 || b.Val > 42) {
+			t.Errorf("Expected bmi of about 18 to 40, but %s has %v", r.ID, b.Val)
+		}
+	}
+
+	again, _ := c.Generate()
+	if !reflect.DeepEqual(cases, again) {
+		t.Error("Expected the same seed to generate the same cases")
+	}
+	c.Seed = 2
+	if other, _ := c.Generate(); reflect.DeepEqual(cases, other) {
+		t.Error("Expected another seed to generate other cases")
+	}
+}
+
+func TestCohortDensity(t *testing.T) {
+	c := benchCohort(200, 2000)
+	found := map[float64]int{}
+	for _, d := range []float64{0, 0.5, 1} {
+		c.Density = d
+		cases, controls := c.Generate()
+		m := Candidates(cases, controls, benchKeys)
+		found[d] = m.NumPairs()
+	}
+	if !(found[0] < found[0.5] && found[0.5] < found[1]) {
+		t.Errorf("Expected more candidates the higher the density, but got %v", found)
+	}
+
+	c.Density = 1
+	c.Columns = c.Columns[:3]
+	cases, controls := c.Generate()
+	m := Candidates(cases, controls, benchKeys[:3])
+	if _, b := m.NumItems(); len(controls) != b {
+		t.Errorf("Expected every near control to match a case, but only %d of %d did", b, len(controls))
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	c := benchCohort(20, 50)
+	_, controls := c.Generate()
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, c.Header(), controls); nil != err {
+		t.Fatal(err)
+	}
+	r, err := NewRecordsFromCSV(&buf, true)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(controls, r) {
+		t.Errorf("Expected to read back %v, but got %v", controls, r)
+	}
+}
+
+func BenchmarkRecordMatches(b *testing.B) {
+	cases, controls := benchCohort(100, 10000).Generate()
+	positions := benchKeys.Positions()
+	ranges := make([]Atter, len(benchKeys))
+	for i, k := range benchKeys {
+		ranges[i] = k.Range
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range cases {
+			cases[j].Matches(controls, positions, ranges...)
+		}
+	}
+}
+
+func BenchmarkMatcherQuantityOptimized(b *testing.B) {
+	cases, controls := benchCohort(1000, 20000).Generate()
+	m := Matcher{Tiers: Tiers{benchKeys}, Allowed: 4}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.QuantityOptimized(cases, controls)
+	}
+}
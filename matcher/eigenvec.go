@@ -0,0 +1,156 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A PCAtt is a sample's position in principal component space, compared by
+// the Euclidean distance between positions
+type PCAtt struct {
+	Val []float64
+}
+
+// Equal returns true if a & b are within e (if e is NumericAtt) of each other,
+// otherwise only if they are at the same position. A PCAtt without any
+// components equals nothing, not even another without
+func (a PCAtt) Equal(b Atter, e Atter) bool {
+	v, ok := b.(PCAtt)
+	if !ok || 0 == len(a.Val) || len(a.Val) != len(v.Val) {
+		return false
+	}
+	d := a.Distance(v)
+	if 0 == d {
+		return true
+	}
+	epsilon, ok := e.(NumericAtt)
+	return ok && d <= epsilon.Val
+}
+
+// Distance returns the Euclidean distance from a to b, +Inf if they do not
+// have the same number of components or have none
+func (a PCAtt) Distance(b PCAtt) float64 {
+	if 0 == len(a.Val) || len(a.Val) != len(b.Val) {
+		return math.Inf(1)
+	}
+	s := 0.0
+	for i := range a.Val {
+		s += (a.Val[i] - b.Val[i]) * (a.Val[i] - b.Val[i])
+	}
+	return math.Sqrt(s)
+}
+
+func (a PCAtt) String() string {
+	s := make([]string, len(a.Val))
+	for i, v := range a.Val {
+		s[i] = strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return strings.Join(s, " ")
+}
+
+// NewPCsFromEigenvec reads the top n principal components for each sample
+// from a PLINK or GCTA .eigenvec file, keyed by the IID of the sample. The
+// file may have a header line, as from PLINK 2, which can leave out the FID
+// column. If n is 0 all the components are read
+func NewPCsFromEigenvec(in io.Reader, n int) (map[string]PCAtt, error) {
+	return NewPCsFromEigenvecByFID(in, n, "")
+}
+
+// NewPCsFromEigenvecByFID is NewPCsFromEigenvec keying each sample by its FID
+// & IID joined by sep, as a Reader joins IDColumns FID,IID, unless sep is ""
+func NewPCsFromEigenvecByFID(in io.Reader, n int, sep string) (map[string]PCAtt, error) {
+	s := bufio.NewScanner(newcrReader(in))
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	pcs := make(map[string]PCAtt)
+	id := 1
+	lineno := 0
+	for s.Scan() {
+		lineno++
+		f := strings.Fields(s.Text())
+		if 0 == len(f) {
+			continue
+		}
+		if 1 == lineno && (strings.HasPrefix(f[0], "#") || "FID" == f[0] || "IID" == f[0]) {
+			if "#IID" == f[0] || "IID" == f[0] {
+				if "" != sep {
+					return nil, fmt.Errorf("eigenvec has no FID column to key samples by")
+				}
+				id = 0
+			}
+			continue
+		}
+		if len(f) <= id+1 {
+			return nil, fmt.Errorf("eigenvec line %d has no components", lineno)
+		}
+		v := f[id+1:]
+		if n > 0 {
+			if len(v) < n {
+				return nil, fmt.Errorf("eigenvec line %d has only %d of %d components", lineno, len(v), n)
+			}
+			v = v[:n]
+		}
+		pc := PCAtt{Val: make([]float64, len(v))}
+		for i, c := range v {
+			p, err := strconv.ParseFloat(c, 64)
+			if nil != err {
+				return nil, fmt.Errorf("eigenvec line %d: %s", lineno, err)
+			}
+			pc.Val[i] = p
+		}
+		key := f[id]
+		if "" != sep {
+			key = f[0] + sep + f[1]
+		}
+		if _, ok := pcs[key]; ok {
+			return nil, fmt.Errorf("eigenvec line %d repeats sample %s", lineno, key)
+		}
+		pcs[key] = pc
+	}
+	return pcs, s.Err()
+}
+
+// AttachPCs adds the principal components from pcs as a new attribute to every
+// Record in each of r, all at the same position, which is returned. Records
+// with fewer attributes than others are padded with missing values. Records
+// without components get an empty PCAtt, their IDs are returned as missing
+func AttachPCs(pcs map[string]PCAtt, r ...Records) (position int, missing []string) {
+	for _, records := range r {
+		for _, v := range records {
+			if len(v.Atts) > position {
+				position = len(v.Atts)
+			}
+		}
+	}
+	for _, records := range r {
+		for i := range records {
+			if !AttachPC(pcs, &records[i], position) {
+				missing = append(missing, records[i].ID)
+			}
+		}
+	}
+	return position, missing
+}
+
+// AttachPC adds the principal components for r from pcs as the attribute at
+// position, which must be no less than the number r has. It returns false if
+// r has no components, giving it an empty PCAtt. That is not a missing value,
+// so it never matches, whatever the MissingPolicy of the pc Key
+func AttachPC(pcs map[string]PCAtt, r *Record, position int) bool {
+	for len(r.Atts) < position {
+		r.Atts = append(r.Atts, MissingAtt{})
+	}
+	if pc, ok := pcs[r.ID]; ok {
+		r.Atts = append(r.Atts, pc)
+		return true
+	}
+	r.Atts = append(r.Atts, PCAtt{})
+	return false
+}
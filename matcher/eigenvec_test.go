@@ -0,0 +1,148 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher_test
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	. "github.com/oklasoft/mmatcher/matcher"
+)
+
+func TestPCAttsEqual(t *testing.T) {
+	a := PCAtt{[]float64{0.01, -0.02, 0.005}}
+	b := PCAtt{[]float64{0.01, 0.02, 0.005}}
+	if d := a.Distance(b); math.Abs(d-0.04) > 1e-12 {
+		t.Errorf("Expected %v to be 0.04 from %v, but was %v", a, b, d)
+	}
+	if !a.Equal(a, nil) {
+		t.Errorf("%v expected to equal itself", a)
+	}
+	if a.Equal(b, nil) {
+		t.Errorf("%v should not equal %v without a range", a, b)
+	}
+	if !a.Equal(b, NumericAtt{0.05}) {
+		t.Errorf("%v should equal %v within 0.05", a, b)
+	}
+	if b.Equal(a, NumericAtt{0.03}) {
+		t.Errorf("%v should not equal %v within 0.03", b, a)
+	}
+	c := PCAtt{[]float64{0.01, -0.02}}
+	if a.Equal(c, NumericAtt{100}) || !math.IsInf(a.Distance(c), 1) {
+		t.Errorf("%v should not equal %v with fewer components", a, c)
+	}
+}
+
+func TestPCsFromEigenvec(t *testing.T) {
+	plink := `F1 S1 0.01 -0.02 0.03
+F2 S2 -0.01 0.02 0.04
+`
+	pcs, err := NewPCsFromEigenvec(strings.NewReader(plink), 2)
+	if nil != err {
+		t.Fatal("Expected no error reading, but got", err)
+	}
+	if 2 != len(pcs) || 2 != len(pcs["S2"].Val) || -0.01 != pcs["S2"].Val[0] {
+		t.Error("Expected 2 PCs for 2 samples by IID, but got", pcs)
+	}
+
+	plink2 := "#FID\tIID\tPC1\tPC2\tPC3\nF1\tS1\t0.01\t-0.02\t0.03\n"
+	pcs, err = NewPCsFromEigenvec(strings.NewReader(plink2), 0)
+	if nil != err {
+		t.Fatal("Expected no error reading, but got", err)
+	}
+	if 3 != len(pcs["S1"].Val) {
+		t.Error("Expected all 3 PCs for S1, but got", pcs)
+	}
+
+	noFID := "#IID PC1 PC2\nS1 0.01 -0.02\nS2 0.5 0.6\n"
+	pcs, err = NewPCsFromEigenvec(strings.NewReader(noFID), 2)
+	if nil != err {
+		t.Fatal("Expected no error reading, but got", err)
+	}
+	if 0.5 != pcs["S2"].Val[0] {
+		t.Error("Expected PCs by IID without FID, but got", pcs)
+	}
+
+	for _, bad := range []string{
+		"F1 S1 0.1\n",
+		"F1 S1 0.1 nope 0.3\n",
+		"F1 S1\n",
+		"F1 S1 0.1 0.2\nF1 S1 0.1 0.2\n",
+	} {
+		if _, err = NewPCsFromEigenvec(strings.NewReader(bad), 2); nil == err {
+			t.Errorf("Expected an error reading %q", bad)
+		}
+	}
+}
+
+func TestAttachPCs(t *testing.T) {
+	pcs := map[string]PCAtt{
+		"a1": PCAtt{[]float64{0.1, 0.2}},
+		"b1": PCAtt{[]float64{0.1, 0.3}},
+	}
+	a := Records{Record{ID: "a1", Atts: []Atter{TextAtt{"F"}}}}
+	b := Records{
+		Record{ID: "b1", Atts: []Atter{TextAtt{"F"}, NumericAtt{3}}},
+		Record{ID: "b2", Atts: []Atter{TextAtt{"F"}, NumericAtt{3}}},
+	}
+	p, missing := AttachPCs(pcs, a, b)
+	if 2 != p {
+		t.Fatal("Expected PCs at position 2, but got", p)
+	}
+	if 1 != len(missing) || "b2" != missing[0] {
+		t.Error("Expected only b2 to be missing PCs, but got", missing)
+	}
+	if 3 != len(a[0].Atts) || !IsMissing(a[0].Atts[1]) {
+		t.Error("Expected a1 to be padded to the PCs, but got", a[0])
+	}
+	k := Key{Position: p, Range: NumericAtt{0.15}, Missing: MissingNeverMatches}
+	if !k.IsMatch(&a[0], &b[0]) {
+		t.Errorf("Expected %v to match %v on PCs", a[0], b[0])
+	}
+	if k.IsMatch(&a[0], &b[1]) {
+		t.Errorf("Expected %v NOT to match %v without PCs", a[0], b[1])
+	}
+	if d := k.Distance(&a[0], &b[0]); math.Abs(d-0.1) > 1e-12 {
+		t.Error("Expected a PC key distance of 0.1, but got", d)
+	}
+	c := Records{Record{ID: "c1", Atts: []Atter{TextAtt{"F"}, NumericAtt{3}}}}
+	AttachPCs(pcs, c)
+	for _, policy := range []MissingPolicy{MissingMatchesMissing, MissingMatchesAny} {
+		k = Key{Position: p, Range: NumericAtt{0.15}, Missing: policy}
+		if k.IsMatch(&c[0], &b[1]) || !math.IsInf(k.Distance(&c[0], &b[1]), 1) {
+			t.Errorf("Expected %v NOT to match %v, neither having PCs, with missing=%v", c[0], b[1], policy)
+		}
+		if k.IsMatch(&a[0], &b[1]) {
+			t.Errorf("Expected %v NOT to match %v without PCs, with missing=%v", a[0], b[1], policy)
+		}
+	}
+}
+
+func TestAttachPCsWithIDColumns(t *testing.T) {
+	reader := NewReader(strings.NewReader("FID,IID,sex\nF1,S1,F\nF2,S1,M\nF3,S3,F\n"))
+	reader.SkipHeader = true
+	reader.IDColumns = []string{"FID", "IID"}
+	r, err := reader.ReadAll()
+	if nil != err {
+		t.Fatal(err)
+	}
+	eigenvec := "#FID\tIID\tPC1\tPC2\nF1\tS1\t0.1\t0.2\nF2\tS1\t0.3\t0.4\n"
+	pcs, err := NewPCsFromEigenvecByFID(strings.NewReader(eigenvec), 2, reader.IDSeparator)
+	if nil != err {
+		t.Fatal(err)
+	}
+	p, missing := AttachPCs(pcs, r.Records)
+	if 1 != len(missing) || "F3_S3" != missing[0] {
+		t.Error("Expected only F3_S3 to be missing PCs, but got", missing)
+	}
+	if pc, ok := r.Records[1].Atts[p].(PCAtt); !ok || 0.3 != pc.Val[0] {
+		t.Error("Expected F2_S1 to have its own PCs, but got", r.Records[1].Atts[p])
+	}
+
+	if _, err := NewPCsFromEigenvecByFID(strings.NewReader("#IID PC1\nS1 0.1\n"), 1, "_"); nil == err {
+		t.Error("Expected an error keying by FID without an FID column")
+	}
+}
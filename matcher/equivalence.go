@@ -0,0 +1,133 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// An EquivAtt is used in place of a +/- range for a column whose values are
+// coded differently between sources. Values in the same class are considered
+// equal, so "M", "Male" & "1" can all match each other
+type EquivAtt struct {
+	Classes map[string]string
+}
+
+// NewEquivAtt creates an empty set of equivalence classes
+func NewEquivAtt() EquivAtt {
+	return EquivAtt{Classes: make(map[string]string)}
+}
+
+// AddClass puts all of values into the same class, named by the first value
+func (q EquivAtt) AddClass(values ...string) {
+	if len(values) <= 0 {
+		return
+	}
+	for _, v := range values {
+		q.Classes[v] = values[0]
+	}
+}
+
+// Class returns the name of the class for a, if it has one
+func (q EquivAtt) Class(a Atter) (c string, ok bool) {
+	if nil == a {
+		return "", false
+	}
+	c, ok = q.Classes[a.String()]
+	return
+}
+
+// Equal returns true if a & b are in the same class. If either one is not in
+// any class a & b are compared as they are
+func (q EquivAtt) Equal(a Atter, b Atter) bool {
+	ca, aok := q.Class(a)
+	cb, bok := q.Class(b)
+	if aok && bok {
+		return ca == cb
+	}
+	if nil == a || nil == b {
+		return false
+	}
+	return a.Equal(b, nil)
+}
+
+// Unmapped returns the sorted distinct values from column i of r that are not
+// in any class. Missing values are not included
+func (q EquivAtt) Unmapped(r Records, i int) (u []string) {
+	seen := make(map[string]bool)
+	for _, v := range r {
+		if i < 0 || i >= len(v.Atts) || IsMissing(v.Atts[i]) {
+			continue
+		}
+		if _, ok := q.Class(v.Atts[i]); ok {
+			continue
+		}
+		s := v.Atts[i].String()
+		if !seen[s] {
+			seen[s] = true
+			u = append(u, s)
+		}
+	}
+	sort.Strings(u)
+	return u
+}
+
+func (q EquivAtt) String() string {
+	classes := make(map[string][]string)
+	names := []string{}
+	for v, c := range q.Classes {
+		if _, ok := classes[c]; !ok {
+			names = append(names, c)
+		}
+		classes[c] = append(classes[c], v)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, c := range names {
+		sort.Strings(classes[c])
+		parts[i] = fmt.Sprintf("%s=%s", c, strings.Join(classes[c], "|"))
+	}
+	return strings.Join(parts, " ")
+}
+
+// NewEquivalencesFromCSV parses a CSV formatted io.Reader of equivalence
+// classes. Each line is a key column followed by the values that are to be
+// considered equal in that column, the first of which names the class. A
+// column may have any number of lines. Lines starting with # are ignored.
+// The returned map is keyed by the column as written in the input
+func NewEquivalencesFromCSV(in io.Reader) (map[string]EquivAtt, error) {
+	r := csv.NewReader(newcrReader(in))
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	q := make(map[string]EquivAtt)
+	for {
+		line, err := r.Read()
+		if io.EOF == err {
+			break
+		} else if nil != err {
+			return nil, err
+		}
+		if len(line) < 2 {
+			return nil, fmt.Errorf("equivalence for column %q has no values", line[0])
+		}
+		k := strings.TrimSpace(line[0])
+		if _, ok := q[k]; !ok {
+			q[k] = NewEquivAtt()
+		}
+		for _, v := range line[1:] {
+			if c, ok := q[k].Classes[v]; ok {
+				return nil, fmt.Errorf("value %q for column %q already in class %q", v, k, c)
+			}
+		}
+		q[k].AddClass(line[1:]...)
+	}
+	return q, nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher_test
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/oklasoft/mmatcher/matcher"
+)
+
+func TestEquivAttEqual(t *testing.T) {
+	q := NewEquivAtt()
+	q.AddClass("Male", "M", "1")
+	q.AddClass("Female", "F", "2")
+
+	if !(TextAtt{"M"}).Equal(TextAtt{"Male"}, q) {
+		t.Error("M expected to equal Male in", q)
+	}
+	if !(TextAtt{"M"}).Equal(NumericAtt{1}, q) {
+		t.Error("M expected to equal numeric 1 in", q)
+	}
+	if !(NumericAtt{1}).Equal(TextAtt{"Male"}, q) {
+		t.Error("numeric 1 expected to equal Male in", q)
+	}
+	if (TextAtt{"M"}).Equal(TextAtt{"F"}, q) {
+		t.Error("M expected NOT to equal F in", q)
+	}
+	if (NumericAtt{1}).Equal(NumericAtt{2}, q) {
+		t.Error("1 expected NOT to equal 2 in", q)
+	}
+	if !(TextAtt{"U"}).Equal(TextAtt{"U"}, q) {
+		t.Error("Unmapped values expected to still equal themselves")
+	}
+	if (TextAtt{"U"}).Equal(TextAtt{"M"}, q) {
+		t.Error("Unmapped value expected NOT to equal a mapped one")
+	}
+}
+
+func TestEquivAttUnmapped(t *testing.T) {
+	q := NewEquivAtt()
+	q.AddClass("White", "Caucasian", "EUR")
+	r := Records{
+		Record{ID: "a1", Atts: []Atter{TextAtt{"White"}}},
+		Record{ID: "a2", Atts: []Atter{TextAtt{"Asian"}}},
+		Record{ID: "a3", Atts: []Atter{TextAtt{"EUR"}}},
+		Record{ID: "a4", Atts: []Atter{TextAtt{"Asian"}}},
+		Record{ID: "a5", Atts: []Atter{TextAtt{"Black"}}},
+		Record{ID: "a6", Atts: []Atter{MissingAtt{"NA"}}},
+	}
+	u := q.Unmapped(r, 0)
+	if 2 != len(u) || "Asian" != u[0] || "Black" != u[1] {
+		t.Error("Expected Asian & Black to be unmapped, but got", u)
+	}
+	if u = q.Unmapped(r, 5); 0 != len(u) {
+		t.Error("Expected nothing unmapped past the end of the records, but got", u)
+	}
+}
+
+func TestEquivalencesFromCSV(t *testing.T) {
+	csv := `# sex codes
+1,Male,M,1
+1,Female,F,2
+3,White,Caucasian,EUR`
+	q, err := NewEquivalencesFromCSV(strings.NewReader(csv))
+	if err != nil {
+		t.Fatal("Expected no error parsing, but got ", err)
+	}
+	if 2 != len(q) {
+		t.Fatal("Expected equivalences for 2 columns, but got", q)
+	}
+	if c, ok := q["1"].Class(NumericAtt{2}); !ok || "Female" != c {
+		t.Error("Expected 2 to be in class Female, but was", c)
+	}
+	if c, ok := q["3"].Class(TextAtt{"EUR"}); !ok || "White" != c {
+		t.Error("Expected EUR to be in class White, but was", c)
+	}
+
+	_, err = NewEquivalencesFromCSV(strings.NewReader("1,Male,M\n1,Female,M"))
+	if err == nil {
+		t.Error("Expected an error with a value in two classes")
+	}
+	_, err = NewEquivalencesFromCSV(strings.NewReader("1"))
+	if err == nil {
+		t.Error("Expected an error with a column without values")
+	}
+}
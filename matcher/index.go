@@ -0,0 +1,342 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An Index splits controls into blocks by their values in the keys that must
+// match exactly, those without a range. Within each block controls are also
+// indexed by their values in the numeric keys with a window, sorted for one
+// such key or in a k-d tree for several. Finding the matches for a case then
+// only has to check the controls in its block within its windows. The blocks &
+// windows work either way round, so an Index of cases can instead be searched
+// for the cases each control matches with MatchedBy
+type Index struct {
+	records Records
+	c       Criterion
+	keys    Keys
+	windows []window
+	blocks  map[string]*block
+}
+
+// A window is a numeric column in which matches must be within width
+type window struct {
+	position int
+	width    float64
+}
+
+// A block is the controls with the same values in the exact keys
+type block struct {
+	all  []int      // every control in the block, in order
+	rest []int      // controls without a number in every window
+	tree *rangeTree // controls with a number in every window
+}
+
+// NewIndex creates an Index of controls for finding matches on Criterion c
+func NewIndex(controls Records, c Criterion) *Index {
+	x := &Index{records: controls, c: c, blocks: make(map[string]*block)}
+	for _, k := range exactKeys(c) {
+		if blockable(controls, k) {
+			x.keys = append(x.keys, k)
+		}
+	}
+	x.windows = windows(c)
+	for i := range controls {
+		if b, ok := x.block(&controls[i]); ok {
+			if _, ok := x.blocks[b]; !ok {
+				x.blocks[b] = &block{}
+			}
+			x.blocks[b].all = append(x.blocks[b].all, i)
+		}
+	}
+	if len(x.windows) > 0 {
+		for _, b := range x.blocks {
+			points := []rangePoint{}
+			for _, i := range b.all {
+				if v, ok := x.values(&controls[i]); ok {
+					points = append(points, rangePoint{v: v, i: i})
+				} else {
+					b.rest = append(b.rest, i)
+				}
+			}
+			b.tree = newRangeTree(points, len(x.windows))
+		}
+	}
+	return x
+}
+
+// Matches returns a slice containing the indices of the controls that match
+// to a, in the same order as Record.MatchesOn would
+func (x *Index) Matches(a *Record) (matches []int) {
+	for _, i := range x.candidates(a) {
+		if x.c.IsMatch(a, &x.records[i]) {
+			matches = append(matches, i)
+		}
+	}
+	return matches
+}
+
+// MatchedBy returns a slice containing the indices, in order, of the cases
+// that control b matches to, for an Index of cases rather than controls
+func (x *Index) MatchedBy(b *Record) (matches []int) {
+	for _, i := range x.candidates(b) {
+		if x.c.IsMatch(&x.records[i], b) {
+			matches = append(matches, i)
+		}
+	}
+	return matches
+}
+
+// candidates returns the indices, in order, of the records in the same block
+// as r & within its windows
+func (x *Index) candidates(r *Record) []int {
+	name, ok := x.block(r)
+	if !ok {
+		return nil
+	}
+	b, ok := x.blocks[name]
+	if !ok {
+		return nil
+	}
+	candidates := b.all
+	if v, ok := x.values(r); ok && nil != b.tree {
+		lo := make([]float64, len(v))
+		hi := make([]float64, len(v))
+		for d, w := range x.windows {
+			// a little extra room so rounding cannot lose a match, each
+			// candidate is still checked in full
+			slack := 1e-9 * (math.Abs(v[d]) + w.width)
+			lo[d] = v[d] - w.width - slack
+			hi[d] = v[d] + w.width + slack
+		}
+		candidates = b.tree.search(lo, hi, append([]int{}, b.rest...))
+		sort.Ints(candidates)
+	}
+	return candidates
+}
+
+// values returns the numbers of r in each of the windows, false if r does not
+// have a finite number in all of them
+func (x *Index) values(r *Record) ([]float64, bool) {
+	v := make([]float64, len(x.windows))
+	for d, w := range x.windows {
+		if w.position < 0 || w.position >= len(r.Atts) {
+			return nil, false
+		}
+		n, ok := r.Atts[w.position].(NumericAtt)
+		if !ok || math.IsNaN(n.Val) || math.IsInf(n.Val, 0) {
+			return nil, false
+		}
+		v[d] = n.Val
+	}
+	return v, true
+}
+
+// block returns the name of the block for r, false if it cannot match anything
+func (x *Index) block(r *Record) (string, bool) {
+	parts := make([]string, len(x.keys))
+	for i, k := range x.keys {
+		if k.Position < 0 || k.Position >= len(r.Atts) {
+			return "", false
+		}
+		a := r.Atts[k.Position]
+		if IsMissing(a) {
+			if MissingNeverMatches == k.Missing {
+				return "", false
+			}
+			parts[i] = "m"
+			continue
+		}
+		if q, ok := k.Range.(EquivAtt); ok {
+			if c, ok := q.Class(a); ok {
+				parts[i] = "c" + c
+				continue
+			}
+		}
+		switch v := a.(type) {
+		case TextAtt:
+			parts[i] = "t" + v.Val
+		case NumericAtt:
+			if math.IsNaN(v.Val) {
+				return "", false
+			}
+			if 0 == v.Val {
+				v.Val = 0 // -0 is the same block as 0
+			}
+			parts[i] = "n" + strconv.FormatFloat(v.Val, 'g', -1, 64)
+		default:
+			// never equal to anything in a blockable column
+			return "", false
+		}
+	}
+	for i, p := range parts {
+		parts[i] = strconv.Itoa(len(p)) + ":" + p
+	}
+	return strings.Join(parts, ""), true
+}
+
+// exactKeys returns the Keys in c that have to match exactly on their own
+func exactKeys(c Criterion) (keys Keys) {
+	switch v := c.(type) {
+	case Key:
+		return exactKeys(Keys{v})
+	case Keys:
+		for _, k := range v {
+			if MissingMatchesAny == k.Missing {
+				continue
+			}
+			if _, ok := k.Range.(EquivAtt); ok || nil == k.Range {
+				keys = append(keys, k)
+			}
+		}
+	case ScoredKeys:
+		for _, k := range v.Keys {
+			if k.Weight <= 0 {
+				keys = append(keys, exactKeys(k)...)
+			}
+		}
+	case Criteria:
+		for _, m := range v {
+			keys = append(keys, exactKeys(m)...)
+		}
+	}
+	return keys
+}
+
+// windows returns the numeric windows that must hold for any match on c. A
+// key with a Weight can be no further than the whole Max Score allows
+func windows(c Criterion) (w []window) {
+	switch v := c.(type) {
+	case Key:
+		return windows(Keys{v})
+	case Keys:
+		for _, k := range v {
+			if r, ok := k.Range.(NumericAtt); ok && r.Val > 0 && MissingMatchesAny != k.Missing {
+				w = append(w, window{k.Position, r.Val})
+			}
+		}
+	case ScoredKeys:
+		for _, k := range v.Keys {
+			if k.Weight <= 0 {
+				w = append(w, windows(k)...)
+				continue
+			}
+			switch k.Range.(type) {
+			case EquivAtt, AbsAtt:
+				continue
+			}
+			if MissingMatchesAny != k.Missing && v.Max >= 0 {
+				w = append(w, window{k.Position, v.Max / k.Weight})
+			}
+		}
+	case Criteria:
+		for _, m := range v {
+			w = append(w, windows(m)...)
+		}
+	}
+	return w
+}
+
+// blockable returns true if every value of r in the column of k can be put
+// into a block
+func blockable(r Records, k Key) bool {
+	for i := range r {
+		if k.Position < 0 || k.Position >= len(r[i].Atts) {
+			continue
+		}
+		switch r[i].Atts[k.Position].(type) {
+		case TextAtt, NumericAtt, MissingAtt:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// A rangePoint is the numbers in each window for the control at i
+type rangePoint struct {
+	v []float64
+	i int
+}
+
+// A rangeTree finds the points within a box. With a single dimension it is
+// just the points sorted, for more it is a k-d tree laid out in place, each
+// node being the median of its slice with those before it to the left
+type rangeTree struct {
+	points []rangePoint
+	dims   int
+}
+
+func newRangeTree(points []rangePoint, dims int) *rangeTree {
+	t := &rangeTree{points: points, dims: dims}
+	if 1 == dims {
+		sort.Sort(byDim{points, 0})
+	} else {
+		t.build(0, len(points), 0)
+	}
+	return t
+}
+
+func (t *rangeTree) build(l, r, depth int) {
+	if r-l <= 1 {
+		return
+	}
+	sort.Sort(byDim{t.points[l:r], depth % t.dims})
+	m := (l + r) / 2
+	t.build(l, m, depth+1)
+	t.build(m+1, r, depth+1)
+}
+
+// search appends the index of each point within lo & hi to found
+func (t *rangeTree) search(lo, hi []float64, found []int) []int {
+	if 1 == t.dims {
+		p := t.points
+		for j := sort.Search(len(p), func(j int) bool { return p[j].v[0] >= lo[0] }); j < len(p) && p[j].v[0] <= hi[0]; j++ {
+			found = append(found, p[j].i)
+		}
+		return found
+	}
+	return t.searchNode(lo, hi, 0, len(t.points), 0, found)
+}
+
+func (t *rangeTree) searchNode(lo, hi []float64, l, r, depth int, found []int) []int {
+	if r <= l {
+		return found
+	}
+	m := (l + r) / 2
+	p := t.points[m]
+	in := true
+	for d := range p.v {
+		if p.v[d] < lo[d] || p.v[d] > hi[d] {
+			in = false
+			break
+		}
+	}
+	if in {
+		found = append(found, p.i)
+	}
+	d := depth % t.dims
+	if lo[d] <= p.v[d] {
+		found = t.searchNode(lo, hi, l, m, depth+1, found)
+	}
+	if hi[d] >= p.v[d] {
+		found = t.searchNode(lo, hi, m+1, r, depth+1, found)
+	}
+	return found
+}
+
+type byDim struct {
+	p []rangePoint
+	d int
+}
+
+func (b byDim) Len() int           { return len(b.p) }
+func (b byDim) Swap(i, j int)      { b.p[i], b.p[j] = b.p[j], b.p[i] }
+func (b byDim) Less(i, j int) bool { return b.p[i].v[b.d] < b.p[j].v[b.d] }
@@ -0,0 +1,97 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher_test
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	. "github.com/oklasoft/mmatcher/matcher"
+)
+
+func randomRecords(rng *rand.Rand, prefix string, n int) Records {
+	sexes := []Atter{TextAtt{"M"}, TextAtt{"F"}, TextAtt{"Male"}, NumericAtt{1}, MissingAtt{"NA"}}
+	r := make(Records, n)
+	for i := range r {
+		race := Atter(NumericAtt{float64(rng.Intn(4))})
+		switch rng.Intn(20) {
+		case 0:
+			race = MissingAtt{""}
+		case 1:
+			race = NumericAtt{math.NaN()}
+		case 2:
+			race = NumericAtt{math.Copysign(0, -1)}
+		}
+		pc := Atter(NumericAtt{rng.NormFloat64()})
+		switch rng.Intn(20) {
+		case 0:
+			pc = MissingAtt{""}
+		case 1:
+			pc = NumericAtt{math.Inf(1)}
+		case 2:
+			pc = TextAtt{"none"}
+		}
+		r[i] = Record{ID: fmt.Sprintf("%s%d", prefix, i), Atts: []Atter{
+			sexes[rng.Intn(len(sexes))],
+			race,
+			NumericAtt{float64(20 + rng.Intn(50))},
+			pc,
+			NumericAtt{rng.Float64()},
+		}}
+	}
+	return r
+}
+
+func TestIndexMatchesSameAsScan(t *testing.T) {
+	rng := rand.New(rand.NewSource(35))
+	cases := randomRecords(rng, "a", 200)
+	controls := randomRecords(rng, "b", 500)
+	q := NewEquivAtt()
+	q.AddClass("Male", "M", "1")
+	rule, err := ParseRule("b.3 >= a.3", nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	criteria := []Criterion{
+		Keys{{Position: 0}, {Position: 1}, {Position: 2, Range: NumericAtt{3}}},
+		Keys{{Position: 0, Range: q}, {Position: 1, Missing: MissingNeverMatches}},
+		Keys{{Position: 0, Missing: MissingMatchesAny}, {Position: 1}},
+		Keys{{Position: 2, Range: NumericAtt{1}}},
+		Keys{{Position: 5}},
+		Keys{{Position: 2, Range: NumericAtt{2}}, {Position: 3, Range: NumericAtt{0.5}}},
+		Keys{{Position: 0}, {Position: 2, Range: NumericAtt{5}}, {Position: 3, Range: NumericAtt{0.3}, Missing: MissingMatchesAny}, {Position: 4, Range: NumericAtt{0.2}}},
+		Keys{{Position: 2, Range: NumericAtt{2}}, {Position: 3, Range: NumericAtt{1}}, {Position: 4, Range: NumericAtt{0.1}}},
+		Keys{{Position: 3, Range: AbsAtt{0.1}}, {Position: 4, Range: NumericAtt{0.05}}},
+		ScoredKeys{Keys: Keys{{Position: 0}, {Position: 2, Weight: 1}}, Max: 2},
+		ScoredKeys{Keys: Keys{{Position: 2, Weight: 1}, {Position: 3, Weight: 10}, {Position: 4, Range: NumericAtt{0.3}}}, Max: 4},
+		Criteria{Keys{{Position: 1}}, rule},
+		rule,
+	}
+	for _, c := range criteria {
+		x := NewIndex(controls, c)
+		for i := range cases {
+			expected := cases[i].MatchesOn(controls, c)
+			if m := x.Matches(&cases[i]); !reflect.DeepEqual(expected, m) {
+				t.Errorf("Expected index matches of %v on %v to be %v, but got %v", cases[i], c, expected, m)
+			}
+		}
+	}
+}
+
+func TestIndexUnblockable(t *testing.T) {
+	a := Record{ID: "a", Atts: []Atter{GeoAtt{35, -97}}}
+	b := Records{
+		Record{ID: "b0", Atts: []Atter{GeoAtt{35, -97}}},
+		Record{ID: "b1", Atts: []Atter{GeoAtt{36, -97}}},
+	}
+	x := NewIndex(b, Keys{{Position: 0}})
+	if m := x.Matches(&a); 1 != len(m) || 0 != m[0] {
+		t.Error("Expected to match only the same location, but got", m)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// A MissingPolicy says how a missing value in a key column matches
+type MissingPolicy int
+
+const (
+	// MissingMatchesMissing lets a missing value match only another missing value
+	MissingMatchesMissing MissingPolicy = iota
+	// MissingNeverMatches keeps a missing value from matching anything
+	MissingNeverMatches
+	// MissingMatchesAny lets a missing value match any value at all
+	MissingMatchesAny
+)
+
+var missingPolicyNames = map[MissingPolicy]string{
+	MissingMatchesMissing: "same",
+	MissingNeverMatches:   "never",
+	MissingMatchesAny:     "any",
+}
+
+func (p MissingPolicy) String() string {
+	if s, ok := missingPolicyNames[p]; ok {
+		return s
+	}
+	return fmt.Sprintf("MissingPolicy(%d)", int(p))
+}
+
+// ParseMissingPolicy returns the MissingPolicy named by s, one of same, never
+// or any
+func ParseMissingPolicy(s string) (MissingPolicy, error) {
+	for p, n := range missingPolicyNames {
+		if n == s {
+			return p, nil
+		}
+	}
+	return MissingMatchesMissing, fmt.Errorf("unknown missing policy %q", s)
+}
+
+// A Key is a single attribute column to match upon & how to compare it.
+// Priority says the order in which keys may be dropped when matching fails,
+// lowest first, with 0 meaning it can never be dropped. A Weight above 0 puts
+// the key into the weighted Score of its Keys
+type Key struct {
+	Position int
+	Range    Atter
+	Missing  MissingPolicy
+	Priority int
+	Weight   float64
+}
+
+// Keys is just a slice of Key types
+type Keys []Key
+
+// NewKeys creates Keys for the columns in positions, using the range from e
+// of the same index if there is one
+func NewKeys(positions []int, e ...Atter) Keys {
+	k := make(Keys, len(positions))
+	for i, p := range positions {
+		k[i].Position = p
+		if i < len(e) {
+			k[i].Range = e[i]
+		}
+	}
+	return k
+}
+
+// IsMatch returns true if the attribute at the Key's position matches between
+// a & b
+func (k Key) IsMatch(a, b *Record) bool {
+	i := k.Position
+	if i < 0 || i >= len(a.Atts) || i >= len(b.Atts) {
+		return false
+	}
+	x, y := a.Atts[i], b.Atts[i]
+	xm, ym := IsMissing(x), IsMissing(y)
+	if xm || ym {
+		switch k.Missing {
+		case MissingNeverMatches:
+			return false
+		case MissingMatchesAny:
+			return true
+		default:
+			return xm && ym
+		}
+	}
+	return x.Equal(y, k.Range)
+}
+
+// Distance returns how far apart a & b are in the Key's column. Numbers are
+// their Distance, or that of their absolute values with an AbsAtt range.
+// Locations are their Distance in kilometers & principal components their
+// Euclidean Distance, +Inf for a sample without any. Any other values are 0
+// apart if they are Equal & 1 if not. Missing values are 0 apart or +Inf,
+// following the MissingPolicy, as is NaN
+func (k Key) Distance(a, b *Record) float64 {
+	i := k.Position
+	if i < 0 || i >= len(a.Atts) || i >= len(b.Atts) {
+		return math.Inf(1)
+	}
+	x, y := a.Atts[i], b.Atts[i]
+	xm, ym := IsMissing(x), IsMissing(y)
+	if xm || ym {
+		if MissingMatchesAny == k.Missing || (MissingMatchesMissing == k.Missing && xm && ym) {
+			return 0
+		}
+		return math.Inf(1)
+	}
+	if g, ok := x.(GeoAtt); ok {
+		if h, ok := y.(GeoAtt); ok {
+			return g.Distance(h)
+		}
+	}
+	if g, ok := x.(PCAtt); ok {
+		if h, ok := y.(PCAtt); ok {
+			return g.Distance(h)
+		}
+	}
+	m, mok := x.(NumericAtt)
+	n, nok := y.(NumericAtt)
+	if _, ok := k.Range.(EquivAtt); !ok && mok && nok {
+		if math.IsNaN(m.Val) || math.IsNaN(n.Val) {
+			return math.Inf(1)
+		}
+		if m.Val == n.Val {
+			return 0
+		}
+		if _, ok := k.Range.(AbsAtt); ok {
+			m.Val, n.Val = math.Abs(m.Val), math.Abs(n.Val)
+		}
+		return m.Distance(n)
+	}
+	if x.Equal(y, k.Range) {
+		return 0
+	}
+	return 1
+}
+
+// IsMatch returns true if a & b match on every one of the Keys
+func (k Keys) IsMatch(a, b *Record) bool {
+	for _, key := range k {
+		if !key.IsMatch(a, b) {
+			return false
+		}
+	}
+	return true
+}
+
+// Score returns the sum of the Distance between a & b on each of the Keys
+// with a Weight, times that Weight
+func (k Keys) Score(a, b *Record) (s float64) {
+	for _, key := range k {
+		if key.Weight > 0 {
+			s += key.Weight * key.Distance(a, b)
+		}
+	}
+	return s
+}
+
+// Distance returns how far apart a & b are on all of the Keys together, the
+// sum of the Distance on each Key. That is times the Weight of a Key with one,
+// or else divided by its range if that is above 0, so keys in different units
+// count alike
+func (k Keys) Distance(a, b *Record) (d float64) {
+	for _, key := range k {
+		w := 1.0
+		switch r := key.Range.(type) {
+		case NumericAtt:
+			if r.Val > 0 {
+				w = 1 / r.Val
+			}
+		case AbsAtt:
+			if r.Val > 0 {
+				w = 1 / r.Val
+			}
+		}
+		if key.Weight > 0 {
+			w = key.Weight
+		}
+		d += w * key.Distance(a, b)
+	}
+	return d
+}
+
+// ScoredKeys is a Criterion for matching on a combined Score, rather than
+// each key on its own. Keys without a Weight still have to match as usual,
+// but those with one only need their total Score to be at most Max
+type ScoredKeys struct {
+	Keys Keys
+	Max  float64
+}
+
+// IsMatch returns true if a & b match on the unweighted keys & have a Score no
+// more than Max
+func (k ScoredKeys) IsMatch(a, b *Record) bool {
+	for _, key := range k.Keys {
+		if key.Weight <= 0 && !key.IsMatch(a, b) {
+			return false
+		}
+	}
+	return k.Keys.Score(a, b) <= k.Max
+}
+
+// Positions returns the column positions of the Keys in order
+func (k Keys) Positions() []int {
+	p := make([]int, len(k))
+	for i, key := range k {
+		p[i] = key.Position
+	}
+	return p
+}
+
+// Dropped returns Tiers of Keys, each with one more key removed than the one
+// before it. Keys are dropped lowest Priority first, & for keys of the same
+// Priority the last one first. Keys with a Priority of 0 are never dropped
+func (k Keys) Dropped() (t Tiers) {
+	order := []int{}
+	for i := len(k) - 1; i >= 0; i-- {
+		if k[i].Priority > 0 {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return k[order[i]].Priority < k[order[j]].Priority
+	})
+	dropped := make(map[int]bool)
+	for _, d := range order {
+		dropped[d] = true
+		keys := Keys{}
+		for i, key := range k {
+			if !dropped[i] {
+				keys = append(keys, key)
+			}
+		}
+		t = append(t, keys)
+	}
+	return t
+}
@@ -0,0 +1,194 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher_test
+
+import (
+	"math"
+	"testing"
+
+	. "github.com/oklasoft/mmatcher/matcher"
+)
+
+func TestParseMissingPolicy(t *testing.T) {
+	for _, p := range []MissingPolicy{MissingMatchesMissing, MissingNeverMatches, MissingMatchesAny} {
+		q, err := ParseMissingPolicy(p.String())
+		if nil != err || p != q {
+			t.Errorf("Expected to parse %s back to itself, but got %s, %v", p, q, err)
+		}
+	}
+	if _, err := ParseMissingPolicy("sometimes"); nil == err {
+		t.Error("Expected an error parsing an unknown policy")
+	}
+}
+
+func TestKeysMissingPolicy(t *testing.T) {
+	a := &Record{ID: "a", Atts: []Atter{MissingAtt{"NA"}, NumericAtt{30}}}
+	b := &Record{ID: "b", Atts: []Atter{TextAtt{"Male"}, MissingAtt{""}}}
+	c := &Record{ID: "c", Atts: []Atter{MissingAtt{""}, NumericAtt{32}}}
+
+	tests := []struct {
+		policy   MissingPolicy
+		a, b     *Record
+		expected bool
+	}{
+		{MissingMatchesMissing, a, b, false},
+		{MissingMatchesMissing, a, c, true},
+		{MissingNeverMatches, a, b, false},
+		{MissingNeverMatches, a, c, false},
+		{MissingMatchesAny, a, b, true},
+		{MissingMatchesAny, b, a, true},
+		{MissingMatchesAny, a, c, true},
+	}
+	for _, test := range tests {
+		k := Key{Position: 0, Missing: test.policy}
+		if test.expected != k.IsMatch(test.a, test.b) {
+			t.Errorf("Expected %v matching %v to %v with policy %s", test.expected, test.a, test.b, test.policy)
+		}
+	}
+
+	k := Keys{{Position: 0, Missing: MissingMatchesAny}, {Position: 1, Range: NumericAtt{5}}}
+	if !k.IsMatch(a, c) {
+		t.Errorf("Expected %v to match %v on %v", a, c, k)
+	}
+	k[1].Range = NumericAtt{1}
+	if k.IsMatch(a, c) {
+		t.Errorf("Expected %v NOT to match %v on %v", a, c, k)
+	}
+	k[1].Missing = MissingMatchesAny
+	if !k.IsMatch(a, b) {
+		t.Errorf("Expected %v to match %v on %v", a, b, k)
+	}
+}
+
+func TestNewKeys(t *testing.T) {
+	k := NewKeys([]int{0, 2}, NumericAtt{5})
+	if 2 != len(k) || 0 != k[0].Position || 2 != k[1].Position {
+		t.Fatal("Expected keys for positions 0 & 2, but got", k)
+	}
+	if nil == k[0].Range || nil != k[1].Range {
+		t.Error("Expected only the first key to have a range, but got", k)
+	}
+	if p := k.Positions(); 2 != len(p) || 2 != p[1] {
+		t.Error("Expected positions back of 0 & 2, but got", p)
+	}
+}
+
+func TestKeysDropped(t *testing.T) {
+	k := Keys{
+		{Position: 0},
+		{Position: 1, Priority: 2},
+		{Position: 2, Priority: 1},
+		{Position: 3},
+		{Position: 4, Priority: 2},
+	}
+	d := k.Dropped()
+	expected := [][]int{
+		{0, 1, 3, 4},
+		{0, 1, 3},
+		{0, 3},
+	}
+	if len(expected) != len(d) {
+		t.Fatal("Expected", len(expected), "tiers of dropped keys, but got", d)
+	}
+	for i, e := range expected {
+		p := d[i].Positions()
+		if len(e) != len(p) {
+			t.Errorf("Expected tier %d to have keys %v, but got %v", i, e, p)
+			continue
+		}
+		for j := range e {
+			if e[j] != p[j] {
+				t.Errorf("Expected tier %d to have keys %v, but got %v", i, e, p)
+				break
+			}
+		}
+	}
+	if d = (Keys{{Position: 0}}).Dropped(); 0 != len(d) {
+		t.Error("Expected no tiers when no keys can be dropped, but got", d)
+	}
+}
+
+func TestKeyDistance(t *testing.T) {
+	q := NewEquivAtt()
+	q.AddClass("Male", "M")
+	a := &Record{ID: "a", Atts: []Atter{NumericAtt{-3}, TextAtt{"M"}, MissingAtt{""}, NumericAtt{math.NaN()}}}
+	b := &Record{ID: "b", Atts: []Atter{NumericAtt{3}, TextAtt{"Male"}, MissingAtt{""}, NumericAtt{1}, GeoAtt{0, 0}}}
+	c := &Record{ID: "c", Atts: []Atter{TextAtt{"3"}, TextAtt{"F"}, NumericAtt{1}, NumericAtt{1}, GeoAtt{0, 0}}}
+
+	tests := []struct {
+		key      Key
+		a, b     *Record
+		expected float64
+	}{
+		{Key{Position: 0}, a, b, 6},
+		{Key{Position: 0, Range: NumericAtt{1}}, a, b, 6},
+		{Key{Position: 0, Range: AbsAtt{}}, a, b, 0},
+		{Key{Position: 0}, a, c, 1},
+		{Key{Position: 1}, a, b, 1},
+		{Key{Position: 1, Range: q}, a, b, 0},
+		{Key{Position: 1, Range: q}, a, c, 1},
+		{Key{Position: 2}, a, b, 0},
+		{Key{Position: 2}, a, c, math.Inf(1)},
+		{Key{Position: 2, Missing: MissingNeverMatches}, a, b, math.Inf(1)},
+		{Key{Position: 2, Missing: MissingMatchesAny}, a, c, 0},
+		{Key{Position: 3}, a, b, math.Inf(1)},
+		{Key{Position: 3}, b, c, 0},
+		{Key{Position: 4}, a, b, math.Inf(1)},
+		{Key{Position: 4}, b, c, 0},
+	}
+	for _, test := range tests {
+		if d := test.key.Distance(test.a, test.b); test.expected != d {
+			t.Errorf("Expected %v distance from %v to %v to be %v, but was %v", test.key, test.a, test.b, test.expected, d)
+		}
+	}
+	c.Atts[4] = GeoAtt{0, 1}
+	if d := (Key{Position: 4}).Distance(b, c); d < 111 || d > 112 {
+		t.Error("Expected a location one degree away to be about 111km, but was", d)
+	}
+}
+
+func TestKeysScore(t *testing.T) {
+	a := &Record{ID: "a", Atts: []Atter{TextAtt{"F"}, NumericAtt{50}, NumericAtt{0.02}}}
+	b := &Record{ID: "b", Atts: []Atter{TextAtt{"M"}, NumericAtt{53}, NumericAtt{-0.03}}}
+	k := Keys{
+		{Position: 0},
+		{Position: 1, Weight: 1},
+		{Position: 2, Weight: 100},
+	}
+	if s := k.Score(a, b); 8 != math.Floor(s+0.5) {
+		t.Error("Expected a score of 8, but got", s)
+	}
+	if (ScoredKeys{Keys: k, Max: 10}).IsMatch(a, b) {
+		t.Error("Expected unweighted keys to still have to match")
+	}
+	k[0].Weight = 2
+	if !(ScoredKeys{Keys: k, Max: 10}).IsMatch(a, b) {
+		t.Error("Expected a score of 10 to match")
+	}
+	if (ScoredKeys{Keys: k, Max: 9.5}).IsMatch(a, b) {
+		t.Error("Expected a score of 10 NOT to match with a max of 9.5")
+	}
+}
+
+func TestKeysDistance(t *testing.T) {
+	a := &Record{ID: "a", Atts: []Atter{TextAtt{"F"}, NumericAtt{50}, NumericAtt{0.02}, NumericAtt{-4}}}
+	b := &Record{ID: "b", Atts: []Atter{TextAtt{"F"}, NumericAtt{53}, NumericAtt{-0.03}, NumericAtt{2}}}
+	tests := []struct {
+		keys     Keys
+		expected float64
+	}{
+		{Keys{{Position: 0}}, 0},
+		{Keys{{Position: 1}}, 3},
+		{Keys{{Position: 1, Range: NumericAtt{6}}}, 0.5},
+		{Keys{{Position: 1, Range: NumericAtt{6}, Weight: 2}}, 6},
+		{Keys{{Position: 3, Range: AbsAtt{4}}}, 0.5},
+		{Keys{{Position: 0}, {Position: 1, Range: NumericAtt{6}}, {Position: 2, Range: NumericAtt{0.1}}}, 1},
+	}
+	for _, test := range tests {
+		if d := test.keys.Distance(a, b); math.Abs(test.expected-d) > 1e-9 {
+			t.Errorf("Expected a distance of %v on %v, but got %v", test.expected, test.keys, d)
+		}
+	}
+}
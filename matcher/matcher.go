@@ -0,0 +1,335 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Matcher finds the optimized matches between cases & controls
+type Matcher struct {
+	Tiers    Tiers    // Keys to match on, each tier tried in turn
+	With     Criteria // Any other Criterion to match in every tier
+	MaxScore float64  // If > 0 keys with a Weight match by Score instead
+	Allowed  int      // Most controls to match to each case
+	Jobs     int      // Workers for finding candidates, 0 for one per CPU
+	Prune    Pruning  // Limit on the candidates kept for each case
+
+	// Report, if set, is called with the ComponentStats of each connected
+	// component of candidates as it is optimized
+	Report func(ComponentStats)
+
+	// ReportTier, if set, is called with the TierStats of each tier once its
+	// candidates are found
+	ReportTier func(TierStats)
+
+	// Checkpoint, if set, is called with the state so far no more often than
+	// every CheckpointEvery, as well as once the candidates for each tier are
+	// found & if stopped by the context. The Checkpoint can be used to Resume
+	// later, though it is only valid until the call returns. An error stops
+	// the Matcher
+	Checkpoint      func(*Checkpoint) error
+	CheckpointEvery time.Duration
+
+	// Resume, if set, is a Checkpoint of this Matcher with the same inputs
+	// to carry on from
+	Resume *Checkpoint
+
+	// Progress, if set, is called with the Progress so far each time a record
+	// is checked for candidates, an optimizer round is done or a component
+	// is optimized. Calls are never made at the same time, records checked
+	// while a call is being made are only counted in the next
+	Progress func(Progress)
+}
+
+// Progress describes how far a Matcher has got through a tier
+type Progress struct {
+	Tier       int // Index of the tier
+	Scanned    int // Records checked for candidates, cases or streamed controls
+	Total      int // Records to check, 0 when streaming as it is not known
+	Candidates int // Candidate pairs found, before any pruning
+	Components int // Connected components of candidates to optimize
+	Optimized  int // Components optimized
+	Rounds     int // Optimizer rounds done, across all the components
+}
+
+// A tracker passes Progress to f, one call at a time, as it is updated from
+// any of the workers. The records scanned & candidates found are counted
+// without locking, as every worker adds to them for every record
+type tracker struct {
+	f          func(Progress)
+	scans      int64
+	candidates int64
+	mu         sync.Mutex
+	p          Progress
+}
+
+// report passes the Progress to f, with the counts so far. mu must be held
+func (t *tracker) report() {
+	t.p.Scanned = int(atomic.LoadInt64(&t.scans))
+	t.p.Candidates = int(atomic.LoadInt64(&t.candidates))
+	t.f(t.p)
+}
+
+// update changes the Progress with u & reports it
+func (t *tracker) update(u func(p *Progress)) {
+	if nil == t.f {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u(&t.p)
+	t.report()
+}
+
+// scanned counts one more record checked, with found candidates. It reports
+// the Progress only if no other report is being made, rather than have the
+// workers wait on each other
+func (t *tracker) scanned(found int) {
+	if nil == t.f {
+		return
+	}
+	atomic.AddInt64(&t.scans, 1)
+	atomic.AddInt64(&t.candidates, int64(found))
+	if t.mu.TryLock() {
+		defer t.mu.Unlock()
+		t.report()
+	}
+}
+
+// TierStats describes the candidate pairs found in one tier
+type TierStats struct {
+	Tier       int // Index of the tier
+	Cases      int // Cases still without enough matches
+	Candidates int // Candidate pairs kept
+	Pruned     int // Candidate pairs pruned
+}
+
+// ComponentStats describes a connected component of the candidate pairs from
+// one tier & the result of optimizing it
+type ComponentStats struct {
+	Tier       int // Index of the tier
+	Component  int // Index of the component within the tier
+	Cases      int // Cases in the component
+	Controls   int // Controls in the component
+	Candidates int // Candidate pairs in the component
+	Pairs      int // Pairs made by optimizing
+}
+
+// criterion returns the Criterion for matching in the given tier
+func (m *Matcher) criterion(tier int) Criterion {
+	c := Criteria{m.Tiers[tier]}
+	if m.MaxScore > 0 {
+		c[0] = ScoredKeys{Keys: m.Tiers[tier], Max: m.MaxScore}
+	}
+	return append(c, m.With...)
+}
+
+// QuantityOptimized returns an optimized MatchSet with up to Allowed controls
+// per case. The first tier is matched & optimized, then cases with fewer than
+// Allowed matches are tried again with the next tier, for only as many more as
+// they need, against the controls not yet used. The returned map gives the index of the tier at which each Pair
+// was made
+func (m *Matcher) QuantityOptimized(cases, controls Records) (n MatchSet, made map[Pair]int) {
+	n, made, _ = m.QuantityOptimizedContext(context.Background(), cases, controls)
+	return n, made
+}
+
+// QuantityOptimizedContext is QuantityOptimized stopping early with the error
+// once ctx is done
+func (m *Matcher) QuantityOptimizedContext(ctx context.Context, cases, controls Records) (n MatchSet, made map[Pair]int, err error) {
+	return m.optimize(ctx, cases, func(tier int, need Records, used map[string]bool, t *tracker) (MatchSet, int, error) {
+		free := Records{}
+		for _, b := range controls {
+			if !used[b.ID] {
+				free = append(free, b)
+			}
+		}
+		if 0 == len(free) {
+			return NewMatchSet(), 0, nil
+		}
+		t.update(func(p *Progress) { p.Total = len(need) })
+		return prunedCandidates(ctx, need, free, m.criterion(tier), m.Prune, m.Jobs, t.scanned)
+	})
+}
+
+// StreamOptimized is QuantityOptimizedContext for controls read one at a time
+// by StreamCandidates rather than all held in memory. open is called for each
+// tier to read the controls again from the start
+func (m *Matcher) StreamOptimized(ctx context.Context, cases Records, open func() (RecordReader, error)) (n MatchSet, made map[Pair]int, err error) {
+	return m.optimize(ctx, cases, func(tier int, need Records, used map[string]bool, t *tracker) (MatchSet, int, error) {
+		in, err := open()
+		if nil != err {
+			return NewMatchSet(), 0, err
+		}
+		return streamCandidates(ctx, need, &unusedReader{in, used}, m.criterion(tier), m.Prune, m.Jobs, t.scanned)
+	})
+}
+
+// An unusedReader skips the Records with IDs in used
+type unusedReader struct {
+	in   RecordReader
+	used map[string]bool
+}
+
+func (u *unusedReader) Read() (Record, error) {
+	for {
+		r, err := u.in.Read()
+		if nil != err || !u.used[r.ID] {
+			return r, err
+		}
+	}
+}
+
+// A checkpointer passes the state of a Matcher to f, no more often than every
+// so long unless forced, & remembers the first error f returns
+type checkpointer struct {
+	f     func(*Checkpoint) error
+	every time.Duration
+	last  time.Time
+	mu    sync.Mutex
+	c     Checkpoint
+	err   error
+}
+
+// save passes on the Checkpoint after it is changed by u
+func (k *checkpointer) save(force bool, u func(c *Checkpoint)) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	u(&k.c)
+	if nil == k.f || nil != k.err || (!force && time.Since(k.last) < k.every) {
+		return
+	}
+	k.last = time.Now()
+	k.err = k.f(&k.c)
+}
+
+// optimize does each tier of QuantityOptimized, with candidates giving the
+// candidate pairs in a tier between the cases still in need & the controls
+// not yet used, along with how many were pruned, & updating the tracker as
+// it goes. It starts from the Resume Checkpoint if there is one & passes on
+// its own Checkpoints, a last one if stopped by ctx
+func (m *Matcher) optimize(ctx context.Context, cases Records, candidates func(tier int, need Records, used map[string]bool, t *tracker) (MatchSet, int, error)) (n MatchSet, made map[Pair]int, err error) {
+	n = NewMatchSet()
+	made = make(map[Pair]int)
+	used := make(map[string]bool)
+	start := 0
+	resume := m.Resume
+	if nil != resume {
+		if resume.Tier < 0 || resume.Tier > len(m.Tiers) {
+			return n, made, fmt.Errorf("checkpoint is at tier %d of only %d", resume.Tier+1, len(m.Tiers))
+		}
+		n = resume.Matched.Copy()
+		for p, tier := range resume.Made {
+			made[p] = tier
+			used[p.b] = true
+		}
+		start = resume.Tier
+	}
+	k := &checkpointer{f: m.Checkpoint, every: m.CheckpointEvery, last: time.Now()}
+	stopped := func(err error) error {
+		if nil != ctx.Err() {
+			k.save(true, func(c *Checkpoint) {})
+		}
+		if nil == err {
+			err = k.err
+		}
+		return err
+	}
+	for tier := start; tier < len(m.Tiers); tier++ {
+		k.save(false, func(c *Checkpoint) {
+			*c = Checkpoint{Tier: tier, Matched: n, Made: made}
+		})
+		need := Records{}
+		quota := make(map[string]int)
+		for _, a := range cases {
+			if have := len(n.MatchesFor(a.ID)); have < m.Allowed {
+				need = append(need, a)
+				quota[a.ID] = m.Allowed - have
+			}
+		}
+		if 0 == len(need) {
+			break
+		}
+		t := &tracker{f: m.Progress, p: Progress{Tier: tier}}
+		var c MatchSet
+		var pruned int
+		have := make(map[int]MatchSet)
+		if nil != resume && resume.Found && tier == resume.Tier {
+			c, pruned = resume.Candidates, resume.Pruned
+			for i, o := range resume.Optimized {
+				have[i] = o
+			}
+		} else if c, pruned, err = candidates(tier, need, used, t); nil != err {
+			return n, made, stopped(err)
+		}
+		resume = nil
+		if nil != m.ReportTier {
+			m.ReportTier(TierStats{
+				Tier:       tier,
+				Cases:      len(need),
+				Candidates: c.NumPairs(),
+				Pruned:     pruned,
+			})
+		}
+		comps := c.Components()
+		t.update(func(p *Progress) {
+			p.Components = len(comps)
+			p.Optimized = len(have)
+		})
+		k.save(true, func(s *Checkpoint) {
+			s.Found, s.Candidates, s.Pruned = true, c, pruned
+			s.Optimized = make(map[int]MatchSet, len(have))
+			for i, o := range have {
+				s.Optimized[i] = o
+			}
+		})
+		opti, err := optimizeComponents(ctx, comps, m.Allowed, quota, m.Jobs, have,
+			func() { t.update(func(p *Progress) { p.Rounds++ }) },
+			func(i int, o MatchSet) {
+				t.update(func(p *Progress) { p.Optimized++ })
+				k.save(false, func(s *Checkpoint) { s.Optimized[i] = o })
+			})
+		if nil != err {
+			return n, made, stopped(err)
+		}
+		if nil != k.err {
+			return n, made, k.err
+		}
+		o := NewMatchSet()
+		for i := range comps {
+			o.Add(opti[i])
+			if nil != m.Report {
+				a, b := comps[i].NumItems()
+				m.Report(ComponentStats{
+					Tier:       tier,
+					Component:  i,
+					Cases:      a,
+					Controls:   b,
+					Candidates: comps[i].NumPairs(),
+					Pairs:      opti[i].NumPairs(),
+				})
+			}
+		}
+		for _, a := range need {
+			have := len(n.MatchesFor(a.ID))
+			for _, b := range o.MatchesFor(a.ID) {
+				if have >= m.Allowed {
+					break
+				}
+				p := NewPair(a.ID, b)
+				n.AddPair(p)
+				made[p] = tier
+				used[b] = true
+				have++
+			}
+		}
+	}
+	return n, made, k.err
+}
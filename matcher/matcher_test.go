@@ -0,0 +1,205 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher_test
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	. "github.com/oklasoft/mmatcher/matcher"
+)
+
+func TestMatcherMaxScore(t *testing.T) {
+	a := Records{
+		Record{ID: "a1", Atts: []Atter{TextAtt{"F"}, NumericAtt{50}, NumericAtt{0.01}}},
+	}
+	b := Records{
+		Record{ID: "b1", Atts: []Atter{TextAtt{"F"}, NumericAtt{58}, NumericAtt{0.01}}},
+		Record{ID: "b2", Atts: []Atter{TextAtt{"M"}, NumericAtt{50}, NumericAtt{0.01}}},
+		Record{ID: "b3", Atts: []Atter{TextAtt{"F"}, NumericAtt{51}, NumericAtt{0.09}}},
+	}
+	m := Matcher{
+		Tiers: Tiers{Keys{
+			{Position: 0},
+			{Position: 1, Range: NumericAtt{2}, Weight: 1},
+			{Position: 2, Range: NumericAtt{0.01}, Weight: 100},
+		}},
+		Allowed: 1,
+	}
+	if o, _ := m.QuantityOptimized(a, b); 0 != o.NumPairs() {
+		t.Error("Expected no matches with each key on its own, but got", o)
+	}
+	m.MaxScore = 8.5
+	o, _ := m.QuantityOptimized(a, b)
+	if c := o.MatchesFor("a1"); 1 != len(c) || "b1" != c[0] {
+		t.Error("Expected a1 to match b1 by score, but got", c)
+	}
+}
+
+func TestMatcherReport(t *testing.T) {
+	a := Records{
+		Record{ID: "a1", Atts: []Atter{TextAtt{"F"}}},
+		Record{ID: "a2", Atts: []Atter{TextAtt{"M"}}},
+		Record{ID: "a3", Atts: []Atter{TextAtt{"M"}}},
+	}
+	b := Records{
+		Record{ID: "b1", Atts: []Atter{TextAtt{"F"}}},
+		Record{ID: "b2", Atts: []Atter{TextAtt{"M"}}},
+		Record{ID: "b3", Atts: []Atter{TextAtt{"F"}}},
+	}
+	stats := []ComponentStats{}
+	m := Matcher{
+		Tiers:   Tiers{Keys{{Position: 0}}},
+		Allowed: 1,
+		Report:  func(s ComponentStats) { stats = append(stats, s) },
+	}
+	m.QuantityOptimized(a, b)
+	expected := []ComponentStats{
+		{Tier: 0, Component: 0, Cases: 1, Controls: 2, Candidates: 2, Pairs: 1},
+		{Tier: 0, Component: 1, Cases: 2, Controls: 1, Candidates: 2, Pairs: 1},
+	}
+	if !reflect.DeepEqual(expected, stats) {
+		t.Errorf("Expected component stats %v, but got %v", expected, stats)
+	}
+}
+
+func TestMatcherStreamOptimized(t *testing.T) {
+	rng := rand.New(rand.NewSource(43))
+	cases := randomRecords(rng, "a", 300)
+	controls := randomRecords(rng, "b", 900)
+	m := Matcher{
+		Tiers: Tiers{
+			Keys{{Position: 0}, {Position: 2, Range: NumericAtt{1}}},
+			Keys{{Position: 0}, {Position: 2, Range: NumericAtt{5}}},
+			Keys{{Position: 2, Range: NumericAtt{5}}},
+		},
+		Allowed: 2,
+	}
+	expected, expectedMade := m.QuantityOptimized(cases, controls)
+	opened := 0
+	o, made, err := m.StreamOptimized(context.Background(), cases, func() (RecordReader, error) {
+		opened++
+		return &recordsReader{r: controls}, nil
+	})
+	if nil != err {
+		t.Fatal("Expected no error streaming, but got", err)
+	}
+	if len(m.Tiers) != opened {
+		t.Errorf("Expected the controls to be read once per tier, but were %d times", opened)
+	}
+	if !reflect.DeepEqual(expectedMade, made) {
+		t.Errorf("Expected the same tiers for every pair streaming, but got %v not %v", made, expectedMade)
+	}
+	for _, r := range cases {
+		if e, g := expected.MatchesFor(r.ID), o.MatchesFor(r.ID); !reflect.DeepEqual(e, g) {
+			t.Errorf("Expected %s to be matched to %v streaming, but got %v", r.ID, e, g)
+		}
+	}
+}
+
+func TestMatcherReportTier(t *testing.T) {
+	a := Records{
+		Record{ID: "a1", Atts: []Atter{NumericAtt{20}}},
+		Record{ID: "a2", Atts: []Atter{NumericAtt{40}}},
+	}
+	b := Records{
+		Record{ID: "b1", Atts: []Atter{NumericAtt{21}}},
+		Record{ID: "b2", Atts: []Atter{NumericAtt{22}}},
+		Record{ID: "b3", Atts: []Atter{NumericAtt{19}}},
+		Record{ID: "b4", Atts: []Atter{NumericAtt{45}}},
+	}
+	stats := []TierStats{}
+	m := Matcher{
+		Tiers: Tiers{
+			Keys{{Position: 0, Range: NumericAtt{2}}},
+			Keys{{Position: 0, Range: NumericAtt{5}}},
+		},
+		Allowed:    1,
+		Prune:      Pruning{Keep: 1},
+		ReportTier: func(s TierStats) { stats = append(stats, s) },
+	}
+	o, _ := m.QuantityOptimized(a, b)
+	if c := o.MatchesFor("a1"); 1 != len(c) || "b1" != c[0] {
+		t.Error("Expected a1 to keep only its nearest candidate b1, but got", c)
+	}
+	expected := []TierStats{
+		{Tier: 0, Cases: 2, Candidates: 1, Pruned: 2},
+		{Tier: 1, Cases: 1, Candidates: 1, Pruned: 0},
+	}
+	if !reflect.DeepEqual(expected, stats) {
+		t.Errorf("Expected tier stats %v, but got %v", expected, stats)
+	}
+}
+
+func TestMatcherProgress(t *testing.T) {
+	rng := rand.New(rand.NewSource(61))
+	cases := randomRecords(rng, "a", 200)
+	controls := randomRecords(rng, "b", 600)
+	last := map[int]Progress{}
+	calls := 0
+	m := Matcher{
+		Tiers: Tiers{
+			Keys{{Position: 0}, {Position: 2, Range: NumericAtt{1}}},
+			Keys{{Position: 2, Range: NumericAtt{5}}},
+		},
+		Allowed: 2,
+		Jobs:    4,
+		Progress: func(p Progress) {
+			calls++
+			last[p.Tier] = p
+		},
+	}
+	found := map[int]int{}
+	m.ReportTier = func(s TierStats) { found[s.Tier] = s.Candidates }
+	if _, _, err := m.QuantityOptimizedContext(context.Background(), cases, controls); nil != err {
+		t.Fatal("Expected no error, but got", err)
+	}
+	if 2 != len(last) || 0 == calls {
+		t.Fatal("Expected progress on both tiers, but got", last)
+	}
+	for tier, p := range last {
+		if p.Total != p.Scanned || 0 == p.Total {
+			t.Errorf("Expected all of tier %d to be scanned, but got %+v", tier, p)
+		}
+		if found[tier] != p.Candidates {
+			t.Errorf("Expected %d candidates in tier %d, but got %+v", found[tier], tier, p)
+		}
+		if p.Components != p.Optimized || 0 == p.Components || p.Rounds < p.Components {
+			t.Errorf("Expected all of tier %d to be optimized, but got %+v", tier, p)
+		}
+	}
+	if p := last[0]; 200 != p.Total {
+		t.Errorf("Expected every case to be scanned in the first tier, but got %+v", p)
+	}
+}
+
+func TestMatcherCancel(t *testing.T) {
+	rng := rand.New(rand.NewSource(67))
+	cases := randomRecords(rng, "a", 200)
+	controls := randomRecords(rng, "b", 600)
+	ctx, cancel := context.WithCancel(context.Background())
+	m := Matcher{
+		Tiers:   Tiers{Keys{{Position: 2, Range: NumericAtt{5}}}},
+		Allowed: 1,
+		Progress: func(p Progress) {
+			if p.Scanned >= 10 {
+				cancel()
+			}
+		},
+	}
+	if _, _, err := m.QuantityOptimizedContext(ctx, cases, controls); context.Canceled != err {
+		t.Error("Expected to be cancelled, but got", err)
+	}
+	if _, _, err := m.StreamOptimized(ctx, cases, func() (RecordReader, error) {
+		return &recordsReader{r: controls}, nil
+	}); context.Canceled != err {
+		t.Error("Expected streaming to be cancelled, but got", err)
+	}
+	if _, _, err := StreamCandidates(ctx, cases, &recordsReader{r: controls}, Keys{{Position: 0}}, Pruning{}, 2); context.Canceled != err {
+		t.Error("Expected candidates to be cancelled, but got", err)
+	}
+}
@@ -5,9 +5,12 @@
 package matcher
 
 import (
+	"container/heap"
+	"context"
 	"fmt"
 	"log"
-	"math"
+	"sort"
+	"sync"
 )
 
 //A Pair is the basic thing that makes up a match
@@ -29,193 +32,314 @@ func (a Pair) Eql(b Pair) bool {
 
 type matches []string
 
-type match struct {
-	m   matches
-	isA bool
-}
-
-func newMatch(l int, is bool) *match {
-	return &match{m: make(matches, l), isA: is}
-}
-
-func (m *match) copy() *match {
-	m2 := newMatch(m.len(), m.isA)
-	copy(m2.m, m.m)
-	return m2
+func (m matches) IndexOf(t string) int {
+	for i, v := range m {
+		if t == v {
+			return i
+		}
+	}
+	return -1
 }
 
-func (m *match) len() int {
-	return len(m.m)
+//MatchSet represents a collection of Pairs more or less. Each ID is interned to
+//an integer once, pairs are kept as arrays of the integers an item is paired with
+type MatchSet struct {
+	*items
 }
 
-func (m *match) append(b string) {
-	m.m = append(m.m, b)
+type items struct {
+	ids   []string
+	index map[string]int32
+	adj   [][]int32
+	isA   []bool
 }
 
-func (m *match) delete(b string) bool {
-	i := m.m.IndexOf(b)
-	if i >= 0 {
-		m.m = append(m.m[:i], m.m[i+1:]...)
-		return true
+//intern returns the integer for ID t, adding it as a B item if it is new
+func (m *items) intern(t string) int32 {
+	if i, ok := m.index[t]; ok {
+		return i
 	}
-	return false
+	i := int32(len(m.ids))
+	m.index[t] = i
+	m.ids = append(m.ids, t)
+	m.adj = append(m.adj, nil)
+	m.isA = append(m.isA, false)
+	return i
 }
 
-func (m match) String() string {
-	return fmt.Sprintf("%v", m.m)
+//has returns the integer for ID t if it has at least one pair
+func (m *items) has(t string) (int32, bool) {
+	i, ok := m.index[t]
+	return i, ok && len(m.adj[i]) > 0
 }
 
-func (m matches) IndexOf(t string) int {
-	for i, v := range m {
-		if t == v {
-			return i
+//delete removes one pairing of b from a's array, a is no longer an A item
+//once it has nothing left
+func (m *items) delete(a, b int32) {
+	v := m.adj[a]
+	for k, p := range v {
+		if b == p {
+			m.adj[a] = append(v[:k], v[k+1:]...)
+			if 0 == len(m.adj[a]) {
+				m.adj[a] = nil
+				m.isA[a] = false
+			}
+			return
 		}
 	}
-	return -1
 }
 
-//MatchSet represents a collection of Pairs more or less
-type MatchSet struct {
-	pairs map[string]*match
+//sorted returns the integers of all the items with pairs, ordered by their IDs
+func (m *items) sorted() []int32 {
+	s := make([]int32, 0, len(m.ids))
+	for i := range m.ids {
+		if len(m.adj[i]) > 0 {
+			s = append(s, int32(i))
+		}
+	}
+	sort.Slice(s, func(i, j int) bool { return m.ids[s[i]] < m.ids[s[j]] })
+	return s
 }
 
 func (m MatchSet) String() (s string) {
-	for k, v := range m.pairs {
-		if v.isA {
-			s += fmt.Sprintf("%s(%t):%v ", k, v.isA, v.m)
+	for i, k := range m.ids {
+		if m.isA[i] && len(m.adj[i]) > 0 {
+			s += fmt.Sprintf("%s(%t):%v ", k, m.isA[i], m.matchesOf(int32(i)))
 		}
 	}
 	return s
 }
 
+func (m *MatchSet) matchesOf(i int32) (r matches) {
+	r = make(matches, len(m.adj[i]))
+	for k, p := range m.adj[i] {
+		r[k] = m.ids[p]
+	}
+	return r
+}
+
 //Copy returns a new copy of the MatchSet
 func (m *MatchSet) Copy() (n MatchSet) {
 	n = NewMatchSet()
-	for k, v := range m.pairs {
-		n.pairs[k] = v.copy()
+	n.ids = append(n.ids, m.ids...)
+	n.isA = append(n.isA, m.isA...)
+	n.adj = make([][]int32, len(m.adj))
+	for i, v := range m.adj {
+		if len(v) > 0 {
+			n.adj[i] = append([]int32(nil), v...)
+		}
+	}
+	for k, i := range m.index {
+		n.index[k] = i
 	}
 	return
 }
 
 //NewMatchSet creates a new MatchSet collection
 func NewMatchSet() MatchSet {
-	return MatchSet{make(map[string]*match)}
+	return MatchSet{&items{index: make(map[string]int32)}}
 }
 
 //AddPair adds a new pair of matched items to the collection
 func (m *MatchSet) AddPair(p Pair) {
-	if _, ok := m.pairs[p.a]; !ok {
-		m.pairs[p.a] = newMatch(0, true)
-	}
-	(m.pairs[p.a]).append(p.b)
-	(m.pairs[p.a]).isA = true
-	if _, ok := m.pairs[p.b]; !ok {
-		m.pairs[p.b] = newMatch(0, false)
-	}
-	(m.pairs[p.b]).append(p.a)
+	a := m.intern(p.a)
+	m.isA[a] = true
+	b := m.intern(p.b)
+	m.adj[a] = append(m.adj[a], b)
+	m.adj[b] = append(m.adj[b], a)
 }
 
 //RemovePair takes a pair of matched items out of the collection if its there
 func (m *MatchSet) RemovePair(p Pair) {
-	m.delete(p.a, p.b)
-	m.delete(p.b, p.a)
-}
-
-//Purge takes a single ID, then removes any and all Pairs that contain at least half of it
-func (m *MatchSet) Purge(i string) {
-	if v, ok := m.pairs[i]; ok {
-		for _, b := range v.m {
-			//defer used, since RemovePair will alter the slice v & its range
-			//this can lead to items being NOT purged, with defer we make sure
-			//we loop through all the items. Defer used in place of copying v for "fun"
-			defer m.RemovePair(NewPair(i, b))
-		}
+	a, okA := m.has(p.a)
+	b, okB := m.has(p.b)
+	if okA && okB {
+		m.delete(a, b)
+		m.delete(b, a)
 	}
 }
 
-func (m *MatchSet) delete(a, b string) {
-	if v, ok := m.pairs[a]; ok {
-		if v.delete(b) {
-			if v.len() <= 0 {
-				delete(m.pairs, a)
-			}
+//Purge takes a single ID, then removes any and all Pairs that contain at least half of it
+func (m *MatchSet) Purge(t string) {
+	if i, ok := m.has(t); ok {
+		for _, p := range m.adj[i] {
+			m.delete(p, i)
 		}
+		m.adj[i] = nil
+		m.isA[i] = false
 	}
 }
 
 //NumPairs returns the number of total pairs/matches in this collection
 func (m *MatchSet) NumPairs() (l int) {
-	for _, v := range m.pairs {
-		l += v.len()
+	for _, v := range m.adj {
+		l += len(v)
 	}
 	return l / 2
 }
 
-func (m *MatchSet) fewestPairs() (t string) {
-	min := math.MaxInt32
-	for k, v := range m.pairs {
-		if v.len() < min {
-			t = k
-			min = v.len()
-		}
-	}
-	return
+//cancelEvery is how many pairs an optimizer round makes between checks for
+//being cancelled
+const cancelEvery = 4096
+
+//pairHeap orders items by their remaining number of pairs, ties going to the
+//lowest ID, so the same set is always optimized the same. Entries are never
+//updated in place, a stale one is skipped when popped
+type pairHeap []pairCount
+
+type pairCount struct {
+	item  int32
+	rank  int
+	count int
 }
 
-func (m *MatchSet) mostPairsOf(t matches) (r string) {
-	max := 0
-	for _, p := range t {
-		if m.pairs[p].len() > max {
-			max = m.pairs[p].len()
-			r = p
-		}
+func (h pairHeap) Len() int { return len(h) }
+
+func (h pairHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
 	}
-	return
+	return h[i].rank < h[j].rank
 }
 
-func (m *MatchSet) minMaxPair() (p Pair) {
-	p.a = m.fewestPairs()
-	if "" != p.a {
-		p.b = m.mostPairsOf(m.pairs[p.a].m)
-	}
-	return p
+func (h pairHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *pairHeap) Push(x interface{}) { *h = append(*h, x.(pairCount)) }
+
+func (h *pairHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
 }
 
 //QuantityOptimized returns an optimized matchset containing only a single
 //pair per item. It attempts to get the largest number of possible pairs without
-//duplicating any single item
+//duplicating any single item. Each connected component is optimized on its own
 func (m *MatchSet) QuantityOptimized(allowed ...int) (n MatchSet) {
 	if len(allowed) <= 0 {
 		allowed = []int{1}
 	}
+	return m.ParallelQuantityOptimized(allowed[0], 1)
+}
+
+//ParallelQuantityOptimized is QuantityOptimized with the components split
+//between jobs workers, or one per CPU if jobs is 0 or less
+func (m *MatchSet) ParallelQuantityOptimized(allowed, jobs int) (n MatchSet) {
 	n = NewMatchSet()
-	if 0 == m.NumPairs() || allowed[0] <= 0 {
+	o, _ := optimizeComponents(context.Background(), m.Components(), allowed, nil, jobs, nil, nil, nil)
+	for _, o := range o {
+		n.Add(o)
+	}
+	return
+}
+
+//quantityOptimized is the optimization of QuantityOptimized for the whole set.
+//It works in rounds, one per allowed pair. Each round repeatedly pairs the
+//item with the fewest remaining pairs to its partner with the most, until no
+//pairs remain; B items paired are then left out of the following rounds, as
+//are A items with as many pairs as their quota, if less than allowed.
+//It stops with the error once ctx is done, calling round, if set, after each
+//round
+func (m *MatchSet) quantityOptimized(ctx context.Context, allowed int, quota map[string]int, round func()) (n MatchSet, err error) {
+	n = NewMatchSet()
+	if 0 == m.NumPairs() || allowed <= 0 {
 		return
 	}
-	c := m.Copy()
-	nextSet := m.Copy()
-	for p := c.minMaxPair(); "" != p.a && "" != p.b; p = c.minMaxPair() {
-		if m.pairs[p.a].isA && m.pairs[p.b].isA {
-			log.Fatal("Both cannot be A")
-		} else if m.pairs[p.b].isA {
-			tmp := p.a
-			p.a = p.b
-			p.b = tmp
-		}
-		c.Purge(p.a)
-		c.Purge(p.b)
-		nextSet.Purge(p.b)
-		n.AddPair(p)
-	}
-	n.Add(nextSet.QuantityOptimized(allowed[0] - 1))
+	ids, adj, isA := m.ids, m.adj, m.isA
+	rank := make([]int, len(ids))
+	for r, i := range m.sorted() {
+		rank[i] = r
+	}
+	limit := make([]int, len(ids))
+	for i := range ids {
+		limit[i] = allowed
+		if q, ok := quota[ids[i]]; ok && isA[i] && q < allowed {
+			limit[i] = q
+		}
+	}
+
+	used := make([]bool, len(ids))
+	gone := make([]bool, len(ids))
+	count := make([]int, len(ids))
+	h := make(pairHeap, 0, len(ids))
+	purge := func(i int32) {
+		gone[i] = true
+		for _, j := range adj[i] {
+			if !gone[j] {
+				count[j]--
+				heap.Push(&h, pairCount{j, rank[j], count[j]})
+			}
+		}
+	}
+
+	for r := 0; r < allowed; r++ {
+		h = h[:0]
+		copy(gone, used)
+		for i := range ids {
+			if r >= limit[i] {
+				gone[i] = true
+			}
+		}
+		for i := range ids {
+			count[i] = 0
+			if gone[i] {
+				continue
+			}
+			for _, j := range adj[i] {
+				if !gone[j] {
+					count[i]++
+				}
+			}
+			if count[i] > 0 {
+				h = append(h, pairCount{int32(i), rank[i], count[i]})
+			}
+		}
+		heap.Init(&h)
+		paired := false
+		for popped := 0; h.Len() > 0; popped++ {
+			if 0 == popped%cancelEvery {
+				if err = ctx.Err(); nil != err {
+					return NewMatchSet(), err
+				}
+			}
+			c := heap.Pop(&h).(pairCount)
+			a := c.item
+			if gone[a] || count[a] != c.count || 0 == c.count {
+				continue
+			}
+			b, most := int32(-1), 0
+			for _, j := range adj[a] {
+				if !gone[j] && count[j] > most {
+					b, most = j, count[j]
+				}
+			}
+			if isA[a] && isA[b] {
+				log.Fatal("Both cannot be A")
+			} else if isA[b] {
+				a, b = b, a
+			}
+			purge(a)
+			purge(b)
+			used[b] = true
+			n.AddPair(NewPair(ids[a], ids[b]))
+			paired = true
+		}
+		if nil != round {
+			round()
+		}
+		if !paired {
+			break
+		}
+	}
 	return
 }
 
 func (m *MatchSet) Add(b MatchSet) {
-	for k, v := range b.pairs {
-		if v.isA {
-			for _, p := range v.m {
-				m.AddPair(NewPair(k, p))
+	for i, k := range b.ids {
+		if b.isA[i] {
+			for _, p := range b.adj[i] {
+				m.AddPair(NewPair(k, b.ids[p]))
 			}
 		}
 	}
@@ -223,10 +347,91 @@ func (m *MatchSet) Add(b MatchSet) {
 
 //MatchesFor returns a copy of the slice of matches for given identifeir.
 func (m *MatchSet) MatchesFor(t string) (r matches) {
-	if v, ok := m.pairs[t]; ok {
-		r = make(matches, v.len())
-		copy(r, v.m)
-		return r
+	if i, ok := m.has(t); ok {
+		return m.matchesOf(i)
 	}
 	return r
 }
+
+//NumItems returns the number of A & B items in this collection
+func (m *MatchSet) NumItems() (a, b int) {
+	for i, v := range m.adj {
+		if 0 == len(v) {
+			continue
+		}
+		if m.isA[i] {
+			a++
+		} else {
+			b++
+		}
+	}
+	return
+}
+
+//Components splits the collection into its connected components, sets of
+//pairs that share no items with any other. They are ordered by their lowest ID
+func (m *MatchSet) Components() (c []MatchSet) {
+	seen := make([]bool, len(m.ids))
+	for _, id := range m.sorted() {
+		if seen[id] {
+			continue
+		}
+		n := NewMatchSet()
+		seen[id] = true
+		queue := []int32{id}
+		for k := 0; k < len(queue); k++ {
+			n.intern(m.ids[queue[k]])
+			for _, p := range m.adj[queue[k]] {
+				if !seen[p] {
+					seen[p] = true
+					queue = append(queue, p)
+				}
+			}
+		}
+		for k, i := range queue {
+			n.isA[k] = m.isA[i]
+			n.adj[k] = make([]int32, len(m.adj[i]))
+			for j, p := range m.adj[i] {
+				n.adj[k][j] = n.index[m.ids[p]]
+			}
+		}
+		c = append(c, n)
+	}
+	return c
+}
+
+//OptimizeComponents returns QuantityOptimized for each of c, in the same
+//order, using jobs workers, or one per CPU if jobs is 0 or less
+func OptimizeComponents(c []MatchSet, allowed, jobs int) []MatchSet {
+	o, _ := optimizeComponents(context.Background(), c, allowed, nil, jobs, nil, nil, nil)
+	return o
+}
+
+//optimizeComponents is OptimizeComponents stopping with the error once ctx is
+//done. A items in quota get no more pairs than given there, rather than
+//allowed. Components in have are already optimized. round, if set, is called
+//after each optimizer round & done with each component once optimized, from
+//any of the workers
+func optimizeComponents(ctx context.Context, c []MatchSet, allowed int, quota map[string]int, jobs int, have map[int]MatchSet, round func(), done func(i int, o MatchSet)) ([]MatchSet, error) {
+	o := make([]MatchSet, len(c))
+	var failed error
+	var mu sync.Mutex
+	err := parallel(ctx, len(c), jobs, func(i int) {
+		if h, ok := have[i]; ok {
+			o[i] = h
+			return
+		}
+		var err error
+		if o[i], err = c[i].quantityOptimized(ctx, allowed, quota, round); nil != err {
+			mu.Lock()
+			failed = err
+			mu.Unlock()
+		} else if nil != done {
+			done(i, o[i])
+		}
+	})
+	if nil == err {
+		err = failed
+	}
+	return o, err
+}
@@ -5,6 +5,8 @@
 package matcher_test
 
 import (
+	"fmt"
+	"reflect"
 	"testing"
 
 	. "github.com/oklasoft/mmatcher/matcher"
@@ -195,3 +197,139 @@ func TestMatchesOptimizedAllowN(t *testing.T) {
 		t.Error("Exected 2 back for a3 for", o)
 	}
 }
+
+func TestComponents(t *testing.T) {
+	m := NewMatchSet()
+	m.AddPair(NewPair("a3", "b3"))
+	m.AddPair(NewPair("a1", "b1"))
+	m.AddPair(NewPair("a1", "b2"))
+	m.AddPair(NewPair("a2", "b2"))
+	m.AddPair(NewPair("a4", "b4"))
+	m.AddPair(NewPair("a3", "b5"))
+	m.AddPair(NewPair("a5", "b5"))
+
+	c := m.Components()
+	if 3 != len(c) {
+		t.Fatal("Expected 3 components, but got", len(c), "in", c)
+	}
+	expected := []struct {
+		pairs, a, b int
+		first       string
+	}{
+		{3, 2, 2, "a1"},
+		{3, 2, 2, "a3"},
+		{1, 1, 1, "a4"},
+	}
+	for i, e := range expected {
+		if e.pairs != c[i].NumPairs() {
+			t.Errorf("Expected component %d to have %d pairs, but got %v", i, e.pairs, c[i])
+		}
+		if a, b := c[i].NumItems(); e.a != a || e.b != b {
+			t.Errorf("Expected component %d to have %d & %d items, but got %d & %d", i, e.a, e.b, a, b)
+		}
+		if 0 == len(c[i].MatchesFor(e.first)) {
+			t.Errorf("Expected component %d to have %s, but got %v", i, e.first, c[i])
+		}
+	}
+	c[0].RemovePair(NewPair("a1", "b1"))
+	if 7 != m.NumPairs() {
+		t.Error("Expected components to be copies, but original changed to", m)
+	}
+	e := NewMatchSet()
+	if c = e.Components(); 0 != len(c) {
+		t.Error("Expected no components from an empty set, but got", c)
+	}
+}
+
+func TestParallelQuantityOptimized(t *testing.T) {
+	m := NewMatchSet()
+	for i := 0; i < 50; i++ {
+		for j := 0; j < 4; j++ {
+			m.AddPair(NewPair(fmt.Sprintf("a%d", i), fmt.Sprintf("b%d", (i*3+j*7)%120)))
+		}
+	}
+	for _, allowed := range []int{1, 2} {
+		expected := m.QuantityOptimized(allowed)
+		for _, jobs := range []int{0, 1, 4} {
+			o := m.ParallelQuantityOptimized(allowed, jobs)
+			for i := 0; i < 50; i++ {
+				id := fmt.Sprintf("a%d", i)
+				if e, g := expected.MatchesFor(id), o.MatchesFor(id); !reflect.DeepEqual(e, g) {
+					t.Errorf("Expected %s to have %v with %d jobs, but got %v", id, e, jobs, g)
+				}
+			}
+		}
+	}
+}
+
+func TestQuantityOptimizedChain(t *testing.T) {
+	//a chain a0-b0-a1-b1-... has exactly one way to pair every item
+	m := NewMatchSet()
+	n := 20000
+	for i := 0; i < n; i++ {
+		m.AddPair(NewPair(fmt.Sprintf("a%d", i), fmt.Sprintf("b%d", i)))
+		if i+1 < n {
+			m.AddPair(NewPair(fmt.Sprintf("a%d", i+1), fmt.Sprintf("b%d", i)))
+		}
+	}
+	o := m.QuantityOptimized(2)
+	if n != o.NumPairs() {
+		t.Fatalf("Expected %d pairs, but got %d", n, o.NumPairs())
+	}
+	for _, i := range []int{0, n / 2, n - 1} {
+		id := fmt.Sprintf("a%d", i)
+		if e, g := []string{fmt.Sprintf("b%d", i)}, o.MatchesFor(id); !reflect.DeepEqual(e, []string(g)) {
+			t.Errorf("Expected %s to have %v, but got %v", id, e, g)
+		}
+	}
+}
+
+func BenchmarkQuantityOptimized(b *testing.B) {
+	m := NewMatchSet()
+	for i := 0; i < 2000; i++ {
+		for j := 0; j < 20; j++ {
+			m.AddPair(NewPair(fmt.Sprintf("a%d", i), fmt.Sprintf("b%d", (i*7+j*131)%8000)))
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.QuantityOptimized(4)
+	}
+}
+
+func TestReAddAfterPurge(t *testing.T) {
+	m := NewMatchSet()
+	m.AddPair(NewPair("A1", "B1"))
+	m.AddPair(NewPair("A1", "B1"))
+	m.AddPair(NewPair("A2", "B1"))
+	m.Purge("A1")
+	if a, b := m.NumItems(); 1 != a || 1 != b || 1 != m.NumPairs() {
+		t.Errorf("Expected 1 A, 1 B & 1 pair after purging duplicates, but got %d, %d & %d in %v", a, b, m.NumPairs(), m)
+	}
+	if o := m.MatchesFor("A1"); 0 != len(o) {
+		t.Error("Expected nothing back for a purged item, but got", o)
+	}
+	m.AddPair(NewPair("A3", "A1"))
+	if a, b := m.NumItems(); 2 != a || 2 != b {
+		t.Errorf("Expected a purged A added back as a B to count as one, but got %d As & %d Bs", a, b)
+	}
+	if o := m.MatchesFor("A1"); 1 != len(o) || "A3" != o[0] {
+		t.Error("Expected A1 to be back with A3, but got", o)
+	}
+}
+
+func BenchmarkAddPair(b *testing.B) {
+	ids := make([]string, 4000)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("id%d", i)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m := NewMatchSet()
+		for j := 0; j < 1000; j++ {
+			for k := 0; k < 50; k++ {
+				m.AddPair(NewPair(ids[j], ids[1000+(j*7+k*13)%3000]))
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+)
+
+// A Pruning limits how many candidate controls are kept for each case, so the
+// candidate pairs stay a manageable size however loose the keys. Either the
+// Keep nearest by Distance are kept, ties going to the first found, or with
+// Random a random Keep of them, chosen the same for every run with one Seed
+type Pruning struct {
+	Keep   int   // Most candidates to keep per case, 0 to keep them all
+	Random bool  // Keep a random choice of candidates, not the nearest
+	Seed   int64 // Seed for the random choice
+}
+
+// Distance returns how far apart a & b are on Criterion c, the Keys.Distance
+// of any Keys in it. Other criteria add nothing
+func Distance(c Criterion, a, b *Record) (d float64) {
+	switch v := c.(type) {
+	case Key:
+		return Keys{v}.Distance(a, b)
+	case Keys:
+		return v.Distance(a, b)
+	case ScoredKeys:
+		return v.Keys.Distance(a, b)
+	case Criteria:
+		for _, m := range v {
+			d += Distance(m, a, b)
+		}
+	}
+	return d
+}
+
+// A candidate is a control found for a case, in the order it was found with
+// its distance from the case
+type candidate struct {
+	order    int
+	id       string
+	distance float64
+}
+
+// A pruner keeps the candidates of a single case allowed by a Pruning as
+// they are found. The nearest are kept in a heap with the furthest on top,
+// random ones by reservoir sampling
+type pruner struct {
+	p     Pruning
+	rng   *rand.Rand
+	found int
+	kept  []candidate
+}
+
+// newPruner returns a pruner for the case with ID id. Its random choices
+// depend only on the Seed & the ID, not on which other cases are pruned
+func newPruner(p Pruning, id string) *pruner {
+	x := &pruner{p: p}
+	if p.Random {
+		h := fnv.New64a()
+		h.Write([]byte(id))
+		x.rng = rand.New(rand.NewSource(p.Seed ^ int64(h.Sum64())))
+	}
+	return x
+}
+
+// add offers c to be kept
+func (x *pruner) add(c candidate) {
+	x.found++
+	switch {
+	case x.p.Keep <= 0 || len(x.kept) < x.p.Keep:
+		x.kept = append(x.kept, c)
+		if !x.p.Random && len(x.kept) == x.p.Keep {
+			heap.Init(x)
+		}
+	case x.p.Random:
+		if i := x.rng.Intn(x.found); i < x.p.Keep {
+			x.kept[i] = c
+		}
+	case c.distance < x.kept[0].distance:
+		x.kept[0] = c
+		heap.Fix(x, 0)
+	}
+}
+
+// candidates returns the candidates kept in the order they were found, & how
+// many were pruned
+func (x *pruner) candidates() ([]candidate, int) {
+	sort.Sort(byOrder(x.kept))
+	return x.kept, x.found - len(x.kept)
+}
+
+// pruner is a heap with the furthest, last found candidate on top
+func (x *pruner) Len() int { return len(x.kept) }
+
+func (x *pruner) Less(i, j int) bool {
+	if x.kept[i].distance != x.kept[j].distance {
+		return x.kept[i].distance > x.kept[j].distance
+	}
+	return x.kept[i].order > x.kept[j].order
+}
+
+func (x *pruner) Swap(i, j int) { x.kept[i], x.kept[j] = x.kept[j], x.kept[i] }
+
+func (x *pruner) Push(c interface{}) { x.kept = append(x.kept, c.(candidate)) }
+
+func (x *pruner) Pop() interface{} {
+	c := x.kept[len(x.kept)-1]
+	x.kept = x.kept[:len(x.kept)-1]
+	return c
+}
+
+type byOrder []candidate
+
+func (c byOrder) Len() int           { return len(c) }
+func (c byOrder) Less(i, j int) bool { return c[i].order < c[j].order }
+func (c byOrder) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
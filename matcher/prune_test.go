@@ -0,0 +1,150 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher_test
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	. "github.com/oklasoft/mmatcher/matcher"
+)
+
+func TestPrunedCandidates(t *testing.T) {
+	a := Records{
+		Record{ID: "a1", Atts: []Atter{TextAtt{"F"}, NumericAtt{50}}},
+		Record{ID: "a2", Atts: []Atter{TextAtt{"M"}, NumericAtt{50}}},
+	}
+	b := Records{
+		Record{ID: "b1", Atts: []Atter{TextAtt{"F"}, NumericAtt{45}}},
+		Record{ID: "b2", Atts: []Atter{TextAtt{"F"}, NumericAtt{52}}},
+		Record{ID: "b3", Atts: []Atter{TextAtt{"F"}, NumericAtt{49}}},
+		Record{ID: "b4", Atts: []Atter{TextAtt{"F"}, NumericAtt{48}}},
+		Record{ID: "b5", Atts: []Atter{TextAtt{"M"}, NumericAtt{60}}},
+	}
+	k := Keys{{Position: 0}, {Position: 1, Range: NumericAtt{10}}}
+	tests := []struct {
+		keep     int
+		expected []string
+		pruned   int
+	}{
+		{0, []string{"b1", "b2", "b3", "b4"}, 0},
+		{1, []string{"b3"}, 3},
+		{2, []string{"b2", "b3"}, 2},
+		{3, []string{"b2", "b3", "b4"}, 1},
+		{9, []string{"b1", "b2", "b3", "b4"}, 0},
+	}
+	for _, test := range tests {
+		m, pruned := PrunedCandidates(a, b, k, Pruning{Keep: test.keep}, 1)
+		if o := m.MatchesFor("a1"); !reflect.DeepEqual(test.expected, []string(o)) {
+			t.Errorf("Expected keeping %d to leave %v, but got %v", test.keep, test.expected, o)
+		}
+		if o := m.MatchesFor("a2"); 1 != len(o) {
+			t.Errorf("Expected keeping %d to leave a2 its only candidate, but got %v", test.keep, o)
+		}
+		if test.pruned != pruned {
+			t.Errorf("Expected keeping %d to prune %d, but pruned %d", test.keep, test.pruned, pruned)
+		}
+	}
+}
+
+func TestPrunedCandidatesNearest(t *testing.T) {
+	rng := rand.New(rand.NewSource(47))
+	cases := randomRecords(rng, "a", 100)
+	controls := randomRecords(rng, "b", 2000)
+	k := Keys{{Position: 0}, {Position: 2, Range: NumericAtt{10}}, {Position: 4, Range: NumericAtt{0.5}}}
+	all := Candidates(cases, controls, k)
+	index := make(map[string]int)
+	for i, r := range controls {
+		index[r.ID] = i
+	}
+	m, pruned := PrunedCandidates(cases, controls, k, Pruning{Keep: 5}, 3)
+	if all.NumPairs()-m.NumPairs() != pruned {
+		t.Errorf("Expected %d pruned, but got %d", all.NumPairs()-m.NumPairs(), pruned)
+	}
+	for i := range cases {
+		found := all.MatchesFor(cases[i].ID)
+		sort.SliceStable(found, func(x, y int) bool {
+			return k.Distance(&cases[i], &controls[index[found[x]]]) < k.Distance(&cases[i], &controls[index[found[y]]])
+		})
+		if len(found) > 5 {
+			found = found[:5]
+		}
+		sort.Slice(found, func(x, y int) bool { return index[found[x]] < index[found[y]] })
+		if o := m.MatchesFor(cases[i].ID); !reflect.DeepEqual(found, o) {
+			t.Errorf("Expected %s to keep its nearest %v, but got %v", cases[i].ID, found, o)
+		}
+	}
+}
+
+func TestPrunedCandidatesRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(53))
+	cases := randomRecords(rng, "a", 100)
+	controls := randomRecords(rng, "b", 2000)
+	k := Keys{{Position: 0}, {Position: 2, Range: NumericAtt{10}}}
+	all := Candidates(cases, controls, k)
+	p := Pruning{Keep: 3, Random: true, Seed: 7}
+	expected, pruned := PrunedCandidates(cases, controls, k, p, 1)
+	if all.NumPairs()-expected.NumPairs() != pruned {
+		t.Errorf("Expected %d pruned, but got %d", all.NumPairs()-expected.NumPairs(), pruned)
+	}
+	m, _ := PrunedCandidates(cases, controls, k, p, 4)
+	s, _, err := StreamCandidates(context.Background(), cases, &recordsReader{r: controls}, k, p, 2)
+	if nil != err {
+		t.Fatal(err)
+	}
+	// the choice for a case does not depend on the others
+	one, _ := PrunedCandidates(cases[10:11], controls, k, p, 1)
+	if e, o := expected.MatchesFor(cases[10].ID), one.MatchesFor(cases[10].ID); !reflect.DeepEqual(e, o) {
+		t.Errorf("Expected %s to keep %v on its own, but got %v", cases[10].ID, e, o)
+	}
+	p.Seed++
+	other, _ := PrunedCandidates(cases, controls, k, p, 1)
+	differ := false
+	for _, r := range cases {
+		e := expected.MatchesFor(r.ID)
+		if n := len(all.MatchesFor(r.ID)); (n < 3 && n != len(e)) || (n >= 3 && 3 != len(e)) {
+			t.Errorf("Expected %s to keep up to 3 of %d, but kept %v", r.ID, n, e)
+		}
+		for _, id := range e {
+			if all.MatchesFor(r.ID).IndexOf(id) < 0 {
+				t.Errorf("Expected %s to keep only its candidates, but kept %s", r.ID, id)
+			}
+		}
+		if o := m.MatchesFor(r.ID); !reflect.DeepEqual(e, o) {
+			t.Errorf("Expected %s to keep %v with more jobs, but got %v", r.ID, e, o)
+		}
+		if o := s.MatchesFor(r.ID); !reflect.DeepEqual(e, o) {
+			t.Errorf("Expected %s to keep %v streaming, but got %v", r.ID, e, o)
+		}
+		differ = differ || !reflect.DeepEqual(e, other.MatchesFor(r.ID))
+	}
+	if !differ {
+		t.Error("Expected another seed to keep other candidates")
+	}
+}
+
+func TestStreamCandidatesNearest(t *testing.T) {
+	rng := rand.New(rand.NewSource(59))
+	cases := randomRecords(rng, "a", 50)
+	controls := randomRecords(rng, "b", 6000)
+	k := ScoredKeys{Keys: Keys{{Position: 0}, {Position: 2, Weight: 1}, {Position: 4, Weight: 10}}, Max: 8}
+	p := Pruning{Keep: 4}
+	expected, expectedPruned := PrunedCandidates(cases, controls, k, p, 1)
+	m, pruned, err := StreamCandidates(context.Background(), cases, &recordsReader{r: controls}, k, p, 3)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if expectedPruned != pruned {
+		t.Errorf("Expected %d pruned streaming, but got %d", expectedPruned, pruned)
+	}
+	for _, r := range cases {
+		if e, o := expected.MatchesFor(r.ID), m.MatchesFor(r.ID); !reflect.DeepEqual(e, o) {
+			t.Errorf("Expected %s to keep %v streaming, but got %v", r.ID, e, o)
+		}
+	}
+}
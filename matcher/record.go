@@ -6,9 +6,14 @@ package matcher
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/csv"
+	"fmt"
 	"io"
+	"math"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
 // A Record holds a data to be matched based on attributes in Atts
@@ -57,10 +62,7 @@ func (a *Record) IsMatchWithRanges(b *Record, e []Atter, positions ...int) bool
 // isMatchAt returns true if single attribute column in i matches between
 // a & b with given +/- range e
 func (a *Record) isMatchAt(b *Record, e Atter, i int) bool {
-	if i >= 0 && i < len(a.Atts) && i < len(b.Atts) {
-		return a.Atts[i].Equal(b.Atts[i], e)
-	}
-	return false
+	return Key{Position: i, Range: e}.IsMatch(a, b)
 }
 
 // Records is just a slice of Record types
@@ -99,48 +101,442 @@ func (r crReader) Read(b []byte) (int, error) {
 	return n, err
 }
 
-//NewRecordsFromCSV parses an CSV formatted io.Reader to create
-//Records for matching. We assume the first line is a header row which
-//is skipped.
-//TODO we should make this more robust with checking number of columns etc
-func NewRecordsFromCSV(in io.Reader, skipHeader bool) (r Records, err error) {
-	csv := csv.NewReader(newcrReader(in))
-	lineno := 0
+// A swapReader swaps two bytes for each other, so the csv package can read
+// another quote character as if it were "
+type swapReader struct {
+	r    io.Reader
+	a, b byte
+}
+
+func (r swapReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	for i := 0; i < n; i++ {
+		b[i] = r.swap(b[i])
+	}
+	return n, err
+}
+
+func (r swapReader) swap(c byte) byte {
+	switch c {
+	case r.a:
+		return r.b
+	case r.b:
+		return r.a
+	}
+	return c
+}
+
+// swapRune is swap for a rune, leaving any that is not a single byte as is
+func (r swapReader) swapRune(c rune) rune {
+	if c < 0 || c >= utf8.RuneSelf {
+		return c
+	}
+	return rune(r.swap(byte(c)))
+}
+
+// swapAll swaps back the bytes in each of the fields
+func (r swapReader) swapAll(fields []string) {
+	for i, f := range fields {
+		if strings.IndexByte(f, r.a) < 0 && strings.IndexByte(f, r.b) < 0 {
+			continue
+		}
+		b := []byte(f)
+		for j := range b {
+			b[j] = r.swap(b[j])
+		}
+		fields[i] = string(b)
+	}
+}
+
+// sniffSize is how much of the input is looked at to sniff the delimiter
+const sniffSize = 64 * 1024
+
+// delimiters are the candidates when sniffing, in order of preference
+var delimiters = []rune{',', '\t', ';', '|'}
+
+// sniff returns the delimiter of the lines in sample, the one of delimiters
+// found the same number of times, outside of quotes, on every line. If none
+// is, the one found most often overall is taken, or , if none are found
+func (r *Reader) sniff(sample []byte) rune {
+	if i := bytes.LastIndexByte(sample, '\n'); i > 0 && len(sample) == sniffSize {
+		sample = sample[:i]
+	}
+	counts := make([][]int, 0)
+	for _, line := range strings.Split(strings.Replace(string(sample), "\r", "\n", -1), "\n") {
+		if "" == line || (0 != r.Comment && strings.HasPrefix(line, string(r.Comment))) {
+			continue
+		}
+		n := make([]int, len(delimiters))
+		quoted := false
+		for _, c := range line {
+			if 0 != r.Quote && c == r.Quote {
+				quoted = !quoted
+			}
+			for j, d := range delimiters {
+				if c == d && !quoted {
+					n[j]++
+				}
+			}
+		}
+		counts = append(counts, n)
+	}
+	best, consistent, most := ',', 0, 0
+	for j, d := range delimiters {
+		total, same := 0, true
+		for _, n := range counts {
+			total += n[j]
+			same = same && n[j] == counts[0][j]
+		}
+		if 0 == total {
+			continue
+		}
+		if same && counts[0][j] > consistent {
+			best, consistent = d, counts[0][j]
+		} else if 0 == consistent && total > most {
+			best, most = d, total
+		}
+	}
+	return best
+}
+
+// A RecordReader gives Records one at a time, returning io.EOF after the last
+type RecordReader interface {
+	Read() (Record, error)
+}
+
+// A Reader reads Records from a CSV formatted input. The first column is the
+// ID, all the others are attributes. Numbers become NumericAtt, any of the
+// Missing tokens become MissingAtt & all else is a TextAtt. The ID can instead
+// come from other columns, given by number starting at 1 for the first or by
+// name in the header, with several joined by the IDSeparator into one. The
+// attributes are then all the columns that are not part of the ID, in order
+type Reader struct {
+	SkipHeader  bool     // First line is a header row to be skipped
+	Missing     []string // Tokens for a missing value, a blank cell by default
+	Comma       rune     // Field delimiter, , by default
+	Sniff       bool     // Work out the Comma from the first lines instead
+	Quote       rune     // Quote character, " by default or 0 for none
+	Comment     rune     // Lines starting with this are skipped, 0 for none
+	IDColumns   []string // Columns making up the ID, the first by default
+	IDSeparator string   // Put between the IDColumns, _ by default
+
+	in     io.Reader
+	csv    *csv.Reader
+	swap   *swapReader
+	lineno int
+	header []string
+	ids    []int
+}
+
+// DefaultIDSeparator is the IDSeparator of a new Reader
+const DefaultIDSeparator = "_"
+
+// NewReader creates a Reader from in. Any of its settings must be changed
+// before the first Read
+func NewReader(in io.Reader) *Reader {
+	return &Reader{
+		Missing:     []string{""},
+		Comma:       ',',
+		Quote:       '"',
+		IDSeparator: DefaultIDSeparator,
+		in:          in,
+	}
+}
+
+// init sets up the csv reader for the settings, sniffing the Comma if need be
+func (r *Reader) init() error {
+	if nil != r.csv {
+		return nil
+	}
+	if r.Quote < 0 || r.Quote >= utf8.RuneSelf || '\n' == r.Quote || '\r' == r.Quote {
+		return fmt.Errorf("invalid quote character %q", r.Quote)
+	}
+	buf := bufio.NewReaderSize(r.in, sniffSize)
+	if r.Sniff {
+		sample, _ := buf.Peek(sniffSize)
+		r.Comma = r.sniff(sample)
+	}
+	if (0 != r.Quote && (r.Quote == r.Comma || r.Quote == r.Comment)) || (0 == r.Quote && '"' == r.Comma) {
+		return fmt.Errorf("the quote character cannot also be the delimiter or comment")
+	}
+	in := newcrReader(buf)
+	comma, comment := r.Comma, r.Comment
+	if '"' != r.Quote {
+		r.swap = &swapReader{in, '"', byte(r.Quote)}
+		in = *r.swap
+		comma = r.swap.swapRune(comma)
+		if 0 != comment {
+			comment = r.swap.swapRune(comment)
+		}
+	}
+	r.csv = csv.NewReader(in)
+	r.csv.Comma = comma
+	r.csv.Comment = comment
+	return nil
+}
+
+// readLine returns the fields of the next line
+func (r *Reader) readLine() ([]string, error) {
+	if err := r.init(); nil != err {
+		return nil, err
+	}
+	r.lineno++
+	line, err := r.csv.Read()
+	if nil != err {
+		return nil, err
+	}
+	if nil != r.swap {
+		r.swap.swapAll(line)
+	}
+	return line, nil
+}
+
+// Read returns the next Record from the input, io.EOF at the end
+func (r *Reader) Read() (Record, error) {
+	if _, err := r.Header(); nil != err {
+		return Record{}, err
+	}
+	line, err := r.readLine()
+	if nil != err {
+		return Record{}, err
+	}
+	if nil == r.ids {
+		if err := r.findIDs(nil); nil != err {
+			return Record{}, err
+		}
+	}
+	id, values, err := r.split(line)
+	if nil != err {
+		return Record{}, err
+	}
+	a := make([]Atter, 0, len(values))
+	for _, v := range values {
+		a = append(a, r.parseAtt(v))
+	}
+	return Record{ID: id, Atts: a}, nil
+}
+
+// Header returns the header row, reading it now if no Records have been read
+// yet. It is nil unless SkipHeader. The columns are in the same order as a
+// Record, the ID first with the names of the IDColumns joined as the IDs are,
+// then the attributes
+func (r *Reader) Header() ([]string, error) {
+	if r.SkipHeader && 0 == r.lineno {
+		line, err := r.readLine()
+		if nil != err {
+			return nil, err
+		}
+		if err := r.findIDs(line); nil != err {
+			return nil, err
+		}
+		id, names, err := r.split(line)
+		if nil != err {
+			return nil, err
+		}
+		r.header = append([]string{id}, names...)
+	}
+	return r.header, nil
+}
+
+// findIDs works out the positions of the IDColumns, looking up any names in
+// the header row
+func (r *Reader) findIDs(header []string) error {
+	if 0 == len(r.IDColumns) {
+		r.ids = []int{0}
+		return nil
+	}
+	r.ids = make([]int, len(r.IDColumns))
+	for i, c := range r.IDColumns {
+		c = strings.TrimSpace(c)
+		if n, err := strconv.Atoi(c); nil == err {
+			if n < 1 {
+				return fmt.Errorf("ID column %s must be 1 or more", c)
+			}
+			r.ids[i] = n - 1
+			continue
+		}
+		r.ids[i] = -1
+		for j, h := range header {
+			if c != strings.TrimSpace(h) {
+				continue
+			}
+			if r.ids[i] >= 0 {
+				return fmt.Errorf("ID column %s is in the header more than once", c)
+			}
+			r.ids[i] = j
+		}
+		if r.ids[i] < 0 {
+			return fmt.Errorf("ID column %s is not a number or a name in the header", c)
+		}
+	}
+	return nil
+}
+
+// split returns the ID made from the IDColumns of line & the other columns
+func (r *Reader) split(line []string) (string, []string, error) {
+	if 1 == len(r.ids) && 0 == r.ids[0] {
+		return line[0], line[1:], nil
+	}
+	id := make([]string, len(r.ids))
+	for i, j := range r.ids {
+		if j >= len(line) {
+			return "", nil, fmt.Errorf("line %d has no column %d for its ID", r.lineno, j+1)
+		}
+		id[i] = line[j]
+	}
+	values := make([]string, 0, len(line))
+	for j, v := range line {
+		isID := false
+		for _, i := range r.ids {
+			isID = isID || i == j
+		}
+		if !isID {
+			values = append(values, v)
+		}
+	}
+	return strings.Join(id, r.IDSeparator), values, nil
+}
 
+// ReadAll returns all the remaining Records from the input, Indexed to be
+// found by ID
+func (r *Reader) ReadAll() (IndexedRecords, error) {
+	var records Records
 	for {
-		lineno++
-		line, err := csv.Read()
+		rec, err := r.Read()
 		if io.EOF == err {
-			err = nil
-			break
+			return records.Indexed(), nil
 		} else if nil != err {
-			return nil, err
+			return IndexedRecords{}, err
 		}
-		if skipHeader && 1 == lineno {
-			continue //skip header
+		records = append(records, rec)
+	}
+}
+
+func (r *Reader) parseAtt(v string) Atter {
+	t := strings.TrimSpace(v)
+	for _, m := range r.Missing {
+		if t == m {
+			return MissingAtt{v}
 		}
-		a := []Atter{}
-		for _, v := range line[1:] {
-			n, err := strconv.ParseFloat(v, 64)
-			if nil == err {
-				a = append(a, NumericAtt{n})
-			} else {
-				a = append(a, TextAtt{v})
-			}
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if nil == err {
+		return NumericAtt{n}
+	}
+	return TextAtt{v}
+}
+
+//NewRecordsFromCSV parses an CSV formatted io.Reader to create
+//Records for matching. If skipHeader the first line is a header row
+//which is skipped. Blank cells are missing values
+//TODO we should make this more robust with checking number of columns etc
+func NewRecordsFromCSV(in io.Reader, skipHeader bool) (r Records, err error) {
+	r, _, err = NewRecordsAndHeaderFromCSV(in, skipHeader)
+	return r, err
+}
+
+// NewRecordsAndHeaderFromCSV is NewRecordsFromCSV also returning the
+// header row, or nil without skipHeader
+func NewRecordsAndHeaderFromCSV(in io.Reader, skipHeader bool) (r Records, header []string, err error) {
+	reader := NewReader(in)
+	reader.SkipHeader = skipHeader
+	all, err := reader.ReadAll()
+	if nil != err {
+		return nil, nil, err
+	}
+	r = all.Records
+	header, err = reader.Header()
+	return r, header, err
+}
+
+// HeaderColumns maps the names in a header row to the positions of the
+// attributes they head, the first column being the ID, for looking up columns
+// by name. A name heading more than one column is mapped to -1, as it cannot
+// say which is meant. Blank names are left out
+func HeaderColumns(header []string) map[string]int {
+	columns := make(map[string]int)
+	for i, n := range header {
+		n = strings.TrimSpace(n)
+		if 0 == i || "" == n {
+			continue
+		}
+		if _, ok := columns[n]; ok {
+			columns[n] = -1
+		} else {
+			columns[n] = i - 1
 		}
-		r = append(r, Record{ID: line[0], Atts: a})
 	}
+	return columns
+}
 
-	return r, nil
+// PairGeo combines the latitude & longitude columns lat & lon of each Record
+// into a GeoAtt, which replaces the attribute at lat. If either is missing the
+// result is missing as well
+func (r Records) PairGeo(lat, lon int) error {
+	for i := range r {
+		a := r[i].Atts
+		if lat < 0 || lon < 0 || lat >= len(a) || lon >= len(a) {
+			return fmt.Errorf("%s has no column %d or %d for a location", r[i].ID, lat+1, lon+1)
+		}
+		if _, ok := a[lat].(GeoAtt); ok {
+			continue
+		}
+		if IsMissing(a[lat]) {
+			continue
+		}
+		if IsMissing(a[lon]) {
+			a[lat] = a[lon]
+			continue
+		}
+		y, yok := a[lat].(NumericAtt)
+		x, xok := a[lon].(NumericAtt)
+		if !yok || !xok || !(math.Abs(y.Val) <= 90) || !(math.Abs(x.Val) <= 180) {
+			return fmt.Errorf("%s has an invalid location of %s, %s", r[i].ID, a[lat], a[lon])
+		}
+		a[lat] = GeoAtt{Lat: y.Val, Lon: x.Val}
+	}
+	return nil
 }
 
-func (r *Records) Get(t string) Record {
+// Get returns the first Record with ID t & true, or false if there is none.
+// It scans all of r, IndexedRecords find a Record in constant time
+func (r *Records) Get(t string) (Record, bool) {
 	for _, v := range *r {
 		if v.ID == t {
-			return v
+			return v, true
 		}
 	}
-	return Record{}
+	return Record{}, false
+}
+
+// IndexedRecords are Records along with an index of their IDs, so a Record
+// can be found by its ID in constant time, as ReadAll returns them. Changing
+// an ID after indexing leaves it out of the index, so call Indexed again
+type IndexedRecords struct {
+	Records
+	ids map[string]int
+}
+
+// Indexed returns r with the index of its IDs. As with Records.Get, the first
+// Record with an ID is the one found
+func (r Records) Indexed() IndexedRecords {
+	ids := make(map[string]int, len(r))
+	for i := len(r) - 1; i >= 0; i-- {
+		ids[r[i].ID] = i
+	}
+	return IndexedRecords{Records: r, ids: ids}
+}
+
+// Get returns the first Record with ID t & true, or false if there is none
+func (r IndexedRecords) Get(t string) (Record, bool) {
+	i, ok := r.ids[t]
+	if !ok {
+		return Record{}, false
+	}
+	if i < len(r.Records) && t == r.Records[i].ID {
+		return r.Records[i], true
+	}
+	return r.Records.Get(t)
 }
 
 // MatchesAll returns a slice containing the indices of r that match to a with
@@ -153,6 +549,17 @@ func (a *Record) MatchesAll(r Records, e ...Atter) []int {
 	return a.Matches(r, positions, e...)
 }
 
+// MatchesOn returns a slice containing the indices from r that match to a on
+// Criterion c, such as Keys or a Rule
+func (a *Record) MatchesOn(r Records, c Criterion) (matches []int) {
+	for i := range r {
+		if c.IsMatch(a, &r[i]) {
+			matches = append(matches, i)
+		}
+	}
+	return
+}
+
 // Matches retruns a slice containing the indices from r that match to a at
 // attributes in positions with any given +/- ranges in e
 func (a *Record) Matches(r Records, positions []int, e ...Atter) (matches []int) {
@@ -5,6 +5,9 @@
 package matcher
 
 import (
+	"io"
+	"math"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -313,3 +316,366 @@ func TestCSVParsingWithCR(t *testing.T) {
 		t.Error("Expected last attribute to be numeric equal to 15, but was not in", r[0].Atts[2])
 	}
 }
+
+func TestCSVParsingMissing(t *testing.T) {
+	csv := `item,type,color,count
+a1,m,,25
+a2,NA,red,.
+a3,f, ,-9`
+	r, err := NewRecordsFromCSV(strings.NewReader(csv), true)
+	if err != nil {
+		t.Fatal("Expected no error parsing, but got ", err)
+	}
+	if !IsMissing(r[0].Atts[1]) || !IsMissing(r[2].Atts[1]) {
+		t.Error("Expected blank cells to be missing, but got", r[0].Atts[1], r[2].Atts[1])
+	}
+	if IsMissing(r[1].Atts[0]) {
+		t.Error("Expected NA not to be missing by default, but got", r[1].Atts[0])
+	}
+
+	reader := NewReader(strings.NewReader(csv))
+	reader.SkipHeader = true
+	reader.Missing = []string{"NA", ".", "-9"}
+	all, err := reader.ReadAll()
+	if err != nil {
+		t.Fatal("Expected no error parsing, but got ", err)
+	}
+	r = all.Records
+	if 3 != len(r) {
+		t.Fatal("Expected 3 records from", r)
+	}
+	tests := []struct {
+		record, att int
+		missing     bool
+	}{
+		{0, 1, false},
+		{1, 0, true},
+		{1, 2, true},
+		{2, 2, true},
+	}
+	for _, test := range tests {
+		if a := r[test.record].Atts[test.att]; test.missing != IsMissing(a) {
+			t.Errorf("Expected %v missing to be %v in %v", a, test.missing, r[test.record])
+		}
+	}
+	if "NA" != r[1].Atts[0].String() {
+		t.Error("Expected missing value to keep its token, but got", r[1].Atts[0])
+	}
+}
+
+func TestReaderRead(t *testing.T) {
+	reader := NewReader(strings.NewReader("id,age\na1,10\na2,20"))
+	reader.SkipHeader = true
+	for _, id := range []string{"a1", "a2"} {
+		r, err := reader.Read()
+		if err != nil {
+			t.Fatal("Expected no error reading, but got", err)
+		}
+		if id != r.ID {
+			t.Errorf("Expected to read %s, but got %v", id, r)
+		}
+	}
+	if _, err := reader.Read(); io.EOF != err {
+		t.Error("Expected EOF after all records, but got", err)
+	}
+}
+
+func TestReaderHeader(t *testing.T) {
+	reader := NewReader(strings.NewReader("id,sex,age\na1,F,10"))
+	if h, err := reader.Header(); nil != err || nil != h {
+		t.Errorf("Expected no header without SkipHeader, but got %v & %v", h, err)
+	}
+	reader = NewReader(strings.NewReader("id,sex,age\na1,F,10"))
+	reader.SkipHeader = true
+	e := []string{"id", "sex", "age"}
+	for i := 0; i < 2; i++ {
+		if h, err := reader.Header(); nil != err || !reflect.DeepEqual(e, h) {
+			t.Errorf("Expected header %v, but got %v & %v", e, h, err)
+		}
+	}
+	if r, err := reader.Read(); nil != err || "a1" != r.ID {
+		t.Errorf("Expected to read a1 after the header, but got %v & %v", r, err)
+	}
+
+	r, h, err := NewRecordsAndHeaderFromCSV(strings.NewReader("id,sex,age\na1,F,10"), true)
+	if nil != err || 1 != len(r) || !reflect.DeepEqual(e, h) {
+		t.Errorf("Expected 1 record & header %v, but got %v, %v & %v", e, r, h, err)
+	}
+}
+
+func TestReaderFormat(t *testing.T) {
+	tests := []struct {
+		in                    string
+		comma, quote, comment rune
+		e                     []string
+	}{
+		{"a1\tF\t10", '\t', '"', 0, []string{"a1", "F", "10"}},
+		{"# exported\na1;F;10", ';', '"', '#', []string{"a1", "F", "10"}},
+		{"a1,'Smith, J',\"10\"", ',', '\'', 0, []string{"a1", "Smith, J", "\"10\""}},
+		{"a1,'it''s',x", ',', '\'', 0, []string{"a1", "it's", "x"}},
+		{"a1,\"F,10", ',', 0, 0, []string{"a1", "\"F", "10"}},
+	}
+	for _, test := range tests {
+		reader := NewReader(strings.NewReader(test.in))
+		reader.Comma, reader.Quote, reader.Comment = test.comma, test.quote, test.comment
+		line, err := reader.readLine()
+		if nil != err {
+			t.Errorf("Expected no error reading %q, but got %s", test.in, err)
+		} else if !reflect.DeepEqual(test.e, line) {
+			t.Errorf("Expected %q from %q, but got %q", test.e, test.in, line)
+		}
+	}
+
+	for _, q := range []rune{',', '\n', 'é'} {
+		reader := NewReader(strings.NewReader("a1,F,10"))
+		reader.Quote = q
+		if _, err := reader.Read(); nil == err {
+			t.Errorf("Expected an error reading with a quote of %q", q)
+		}
+	}
+}
+
+func TestReaderSniff(t *testing.T) {
+	tests := []struct {
+		in string
+		e  rune
+	}{
+		{"id,sex,age\na1,F,10", ','},
+		{"id\tsex\tage\na1\tF, M\t10", '\t'},
+		{"id;sex;age\r\na1;F;10,5", ';'},
+		{"id|\"a;b;c\"|age\na1|F|10", '|'},
+		{"a1,x;y;z\na2,y;z\n", ','},
+		{"a1", ','},
+	}
+	for _, test := range tests {
+		reader := NewReader(strings.NewReader(test.in))
+		reader.Sniff = true
+		reader.SkipHeader = true
+		if _, err := reader.Header(); nil != err {
+			t.Errorf("Expected no error reading %q, but got %s", test.in, err)
+		}
+		if test.e != reader.Comma {
+			t.Errorf("Expected to sniff %q from %q, but got %q", test.e, test.in, reader.Comma)
+		}
+	}
+}
+
+func TestReaderIDColumns(t *testing.T) {
+	in := "fam,sex,iid,age\nf1,F,i1,10\nf2,M,i2,20"
+	tests := []struct {
+		ids    []string
+		header []string
+		e      Records
+	}{
+		{nil, []string{"fam", "sex", "iid", "age"}, Records{
+			{ID: "f1", Atts: []Atter{TextAtt{"F"}, TextAtt{"i1"}, NumericAtt{10}}},
+			{ID: "f2", Atts: []Atter{TextAtt{"M"}, TextAtt{"i2"}, NumericAtt{20}}},
+		}},
+		{[]string{"3"}, []string{"iid", "fam", "sex", "age"}, Records{
+			{ID: "i1", Atts: []Atter{TextAtt{"f1"}, TextAtt{"F"}, NumericAtt{10}}},
+			{ID: "i2", Atts: []Atter{TextAtt{"f2"}, TextAtt{"M"}, NumericAtt{20}}},
+		}},
+		{[]string{"fam", " iid"}, []string{"fam_iid", "sex", "age"}, Records{
+			{ID: "f1_i1", Atts: []Atter{TextAtt{"F"}, NumericAtt{10}}},
+			{ID: "f2_i2", Atts: []Atter{TextAtt{"M"}, NumericAtt{20}}},
+		}},
+	}
+	for _, test := range tests {
+		reader := NewReader(strings.NewReader(in))
+		reader.SkipHeader = true
+		reader.IDColumns = test.ids
+		r, err := reader.ReadAll()
+		if nil != err {
+			t.Fatalf("Expected no error with ID columns %v, but got %s", test.ids, err)
+		}
+		if !reflect.DeepEqual(test.e, r.Records) {
+			t.Errorf("Expected %v with ID columns %v, but got %v", test.e, test.ids, r.Records)
+		}
+		if h, _ := reader.Header(); !reflect.DeepEqual(test.header, h) {
+			t.Errorf("Expected header %v with ID columns %v, but got %v", test.header, test.ids, h)
+		}
+	}
+
+	for _, test := range []struct {
+		ids    []string
+		header bool
+	}{
+		{[]string{"0"}, true},
+		{[]string{"5"}, true},
+		{[]string{"5"}, false},
+		{[]string{"name"}, true},
+		{[]string{"iid"}, false},
+	} {
+		reader := NewReader(strings.NewReader(in))
+		reader.SkipHeader = test.header
+		reader.IDColumns = test.ids
+		if _, err := reader.ReadAll(); nil == err {
+			t.Errorf("Expected an error with ID columns %v & header %t", test.ids, test.header)
+		}
+	}
+	reader := NewReader(strings.NewReader("id,sex,sex\na1,F,F"))
+	reader.SkipHeader = true
+	reader.IDColumns = []string{"sex"}
+	if _, err := reader.Read(); nil == err {
+		t.Error("Expected an error with an ID column named twice in the header")
+	}
+}
+
+func TestHeaderColumns(t *testing.T) {
+	c := HeaderColumns([]string{"id", "sex", " age ", "", "sex", "race"})
+	e := map[string]int{"sex": -1, "age": 1, "race": 4}
+	if !reflect.DeepEqual(e, c) {
+		t.Errorf("Expected %v, but got %v", e, c)
+	}
+}
+
+func TestMatchesOn(t *testing.T) {
+	a := Record{ID: "a0", Atts: []Atter{TextAtt{"red"}, MissingAtt{""}}}
+	b := Records{
+		Record{ID: "b0", Atts: []Atter{TextAtt{"green"}, NumericAtt{5}}},
+		Record{ID: "b1", Atts: []Atter{TextAtt{"red"}, NumericAtt{25}}},
+		Record{ID: "b2", Atts: []Atter{TextAtt{"red"}, MissingAtt{"NA"}}},
+	}
+	k := Keys{{Position: 0}, {Position: 1, Range: NumericAtt{5}}}
+	if m := a.MatchesOn(b, k); 1 != len(m) || 2 != m[0] {
+		t.Error("Expected only missing to match missing, but got", m)
+	}
+	k[1].Missing = MissingMatchesAny
+	if m := a.MatchesOn(b, k); 2 != len(m) {
+		t.Error("Expected missing to match anything with the same color, but got", m)
+	}
+	k[1].Missing = MissingNeverMatches
+	if m := a.MatchesOn(b, k); 0 != len(m) {
+		t.Error("Expected missing to never match, but got", m)
+	}
+}
+
+func TestCSVParsingSpecialNumbers(t *testing.T) {
+	csv := `id,pc1,pc2
+a1,-0.0123,NaN
+a2,0.0123,Inf
+a3,-1.5e-2,-Inf
+a4,nan,+inf`
+	r, err := NewRecordsFromCSV(strings.NewReader(csv), true)
+	if err != nil {
+		t.Fatal("Expected no error parsing, but got ", err)
+	}
+	if 4 != len(r) {
+		t.Fatal("Expected 4 records from", r)
+	}
+	for _, v := range r {
+		for _, a := range v.Atts {
+			if _, ok := a.(NumericAtt); !ok {
+				t.Errorf("Expected %v to be numeric in %v", a, v)
+			}
+		}
+	}
+	k := Keys{{Position: 0, Range: NumericAtt{0.01}}}
+	if k.IsMatch(&r[0], &r[1]) {
+		t.Errorf("Expected %v NOT to match %v on sign", r[0], r[1])
+	}
+	if !k.IsMatch(&r[0], &r[2]) {
+		t.Errorf("Expected %v to match %v", r[0], r[2])
+	}
+	k[0].Range = AbsAtt{0.01}
+	if !k.IsMatch(&r[0], &r[1]) {
+		t.Errorf("Expected %v to match %v by absolute value", r[0], r[1])
+	}
+	k = Keys{{Position: 1, Range: NumericAtt{1}}}
+	if k.IsMatch(&r[0], &r[3]) {
+		t.Errorf("Expected NaN in %v NOT to match %v", r[0], r[3])
+	}
+	if !k.IsMatch(&r[1], &r[3]) {
+		t.Errorf("Expected Inf in %v to match %v", r[1], r[3])
+	}
+	if k.IsMatch(&r[1], &r[2]) {
+		t.Errorf("Expected Inf in %v NOT to match -Inf in %v", r[1], r[2])
+	}
+}
+
+func TestPairGeo(t *testing.T) {
+	r := Records{
+		Record{ID: "a1", Atts: []Atter{TextAtt{"F"}, NumericAtt{35.4676}, NumericAtt{-97.5164}}},
+		Record{ID: "a2", Atts: []Atter{TextAtt{"F"}, MissingAtt{""}, NumericAtt{-95.9928}}},
+		Record{ID: "a3", Atts: []Atter{TextAtt{"M"}, NumericAtt{36.1540}, MissingAtt{"NA"}}},
+	}
+	if err := r.PairGeo(1, 2); nil != err {
+		t.Fatal("Expected no error pairing locations, but got", err)
+	}
+	if g, ok := r[0].Atts[1].(GeoAtt); !ok || 35.4676 != g.Lat || -97.5164 != g.Lon {
+		t.Error("Expected a location in place of the latitude, but got", r[0].Atts[1])
+	}
+	if !IsMissing(r[1].Atts[1]) || !IsMissing(r[2].Atts[1]) {
+		t.Error("Expected locations missing either part to be missing, but got", r[1].Atts[1], r[2].Atts[1])
+	}
+	if err := r.PairGeo(1, 2); nil != err {
+		t.Error("Expected no error pairing locations twice, but got", err)
+	}
+	if err := r.PairGeo(0, 2); nil == err {
+		t.Error("Expected an error pairing a text column as a location")
+	}
+	if err := r.PairGeo(1, 5); nil == err {
+		t.Error("Expected an error pairing a column past the end of the records")
+	}
+	bad := Records{Record{ID: "b1", Atts: []Atter{NumericAtt{95}, NumericAtt{10}}}}
+	if err := bad.PairGeo(0, 1); nil == err {
+		t.Error("Expected an error with a latitude past 90")
+	}
+	for _, v := range [][2]float64{
+		{math.NaN(), 10},
+		{10, math.NaN()},
+		{math.Inf(1), 10},
+		{10, math.Inf(-1)},
+	} {
+		bad := Records{Record{ID: "b1", Atts: []Atter{NumericAtt{v[0]}, NumericAtt{v[1]}}}}
+		if err := bad.PairGeo(0, 1); nil == err {
+			t.Errorf("Expected an error with a location of %v, but got %v", v, bad[0].Atts[0])
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	r := Records{
+		Record{ID: "a1", Atts: []Atter{TextAtt{"F"}}},
+		Record{ID: "a2", Atts: []Atter{TextAtt{"M"}}},
+		Record{ID: "a1", Atts: []Atter{TextAtt{"X"}}},
+	}
+	x := r.Indexed()
+	for _, id := range []string{"a1", "a2"} {
+		e, ok := r.Get(id)
+		if !ok {
+			t.Error("Expected to find", id)
+		}
+		if g, ok := x.Get(id); !ok || !reflect.DeepEqual(e, g) {
+			t.Errorf("Expected the index to find %v for %s, but got %v", e, id, g)
+		}
+	}
+	if g, _ := x.Get("a1"); "F" != g.Atts[0].String() {
+		t.Error("Expected the first record with a duplicate ID, but got", g)
+	}
+	if g, ok := r.Get("a3"); ok {
+		t.Error("Expected no record for a missing ID, but got", g)
+	}
+	if g, ok := x.Get("a3"); ok {
+		t.Error("Expected the index to have no record for a missing ID, but got", g)
+	}
+
+	r[1].ID = "z"
+	if g, ok := x.Get("a2"); ok {
+		t.Error("Expected no record for an ID changed after indexing, but got", g)
+	}
+	if g, ok := r[1:].Indexed().Get("z"); !ok || "M" != g.Atts[0].String() {
+		t.Error("Expected to find z indexing part of the records again, but got", g)
+	}
+
+	loaded, err := NewReader(strings.NewReader("a1,1\na2,2\na1,3")).ReadAll()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if g, ok := loaded.Get("a1"); !ok || "1" != g.Atts[0].String() {
+		t.Error("Expected ReadAll to index the first a1, but got", g)
+	}
+	if 3 != len(loaded.Records) {
+		t.Error("Expected all the records read, but got", loaded.Records)
+	}
+}
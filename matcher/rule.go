@@ -0,0 +1,619 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A Criterion decides if a pair of Records match
+type Criterion interface {
+	IsMatch(a, b *Record) bool
+}
+
+// Criteria is a set of Criterion that must all match
+type Criteria []Criterion
+
+// IsMatch returns true if a & b match on every Criterion in c
+func (c Criteria) IsMatch(a, b *Record) bool {
+	for _, m := range c {
+		if !m.IsMatch(a, b) {
+			return false
+		}
+	}
+	return true
+}
+
+// A Rule is a Criterion from a small expression language, for when matching
+// needs more than each column compared to itself. An expression such as
+//
+//	abs(a.age - b.age) <= 5 && a.sex == b.sex && b.collected >= a.diagnosed
+//
+// is evaluated for each case a & control b. Columns are referred to as a.N or
+// b.N for the Nth data column, starting at 1 like keys, by name as a.name,
+// which may start with digits like a.2nd_dose, or with a["some name"] or a[N].
+// The operators are || && ! == != < <= > >= + - * / & parentheses for
+// grouping. Numbers & "quoted" strings can be used, as well as the functions
+// abs(x), min(x, y), max(x, y) & missing(x). Strings compare in byte order, so
+// dates written as YYYY-MM-DD compare as dates. Missing values make any
+// arithmetic or comparison they are part of false
+type Rule struct {
+	expr    string
+	root    node
+	columns []int
+}
+
+// ParseRule compiles expr into a Rule. Names used for columns are looked up
+// in columns, which can be nil if all columns are referred to by number
+func ParseRule(expr string, columns map[string]int) (*Rule, error) {
+	p := &parser{columns: columns}
+	if err := p.lex(expr); nil != err {
+		return nil, err
+	}
+	root, err := p.parseOr()
+	if nil != err {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("rule: unexpected %q at %d", p.tokens[p.pos].text, p.tokens[p.pos].at)
+	}
+	return &Rule{expr: expr, root: root, columns: p.used}, nil
+}
+
+// IsMatch returns true if the rule evaluates to true for case a & control b
+func (r *Rule) IsMatch(a, b *Record) bool {
+	v := r.root.eval(a, b)
+	return boolKind == v.kind && v.b
+}
+
+func (r *Rule) String() string {
+	return r.expr
+}
+
+// Columns returns the positions of the data columns the rule refers to, of
+// either record, each once in the order they are first used
+func (r *Rule) Columns() []int {
+	return append([]int(nil), r.columns...)
+}
+
+type kind int
+
+const (
+	invalidKind kind = iota
+	missingKind
+	numberKind
+	textKind
+	boolKind
+)
+
+type value struct {
+	kind kind
+	n    float64
+	s    string
+	b    bool
+}
+
+var invalid = value{}
+
+func valueOf(a Atter) value {
+	switch v := a.(type) {
+	case NumericAtt:
+		return value{kind: numberKind, n: v.Val}
+	case TextAtt:
+		return value{kind: textKind, s: v.Val}
+	case MissingAtt:
+		return value{kind: missingKind}
+	case nil:
+		return invalid
+	}
+	return value{kind: textKind, s: a.String()}
+}
+
+type node interface {
+	eval(a, b *Record) value
+}
+
+type literal value
+
+func (l literal) eval(a, b *Record) value {
+	return value(l)
+}
+
+type column struct {
+	control  bool
+	position int
+}
+
+func (c column) eval(a, b *Record) value {
+	r := a
+	if c.control {
+		r = b
+	}
+	if c.position < 0 || c.position >= len(r.Atts) {
+		return invalid
+	}
+	return valueOf(r.Atts[c.position])
+}
+
+type not struct {
+	x node
+}
+
+func (n not) eval(a, b *Record) value {
+	v := n.x.eval(a, b)
+	if boolKind != v.kind {
+		return invalid
+	}
+	return value{kind: boolKind, b: !v.b}
+}
+
+type negate struct {
+	x node
+}
+
+func (n negate) eval(a, b *Record) value {
+	v := n.x.eval(a, b)
+	if numberKind != v.kind {
+		return v.orInvalid()
+	}
+	return value{kind: numberKind, n: -v.n}
+}
+
+// orInvalid passes along a missing value, anything else becomes invalid
+func (v value) orInvalid() value {
+	if missingKind == v.kind {
+		return v
+	}
+	return invalid
+}
+
+type logical struct {
+	op   string
+	x, y node
+}
+
+func (l logical) eval(a, b *Record) value {
+	x := l.x.eval(a, b)
+	if boolKind != x.kind {
+		return invalid
+	}
+	if ("&&" == l.op && !x.b) || ("||" == l.op && x.b) {
+		return x
+	}
+	y := l.y.eval(a, b)
+	if boolKind != y.kind {
+		return invalid
+	}
+	return y
+}
+
+type binary struct {
+	op   string
+	x, y node
+}
+
+func (o binary) eval(a, b *Record) value {
+	x, y := o.x.eval(a, b), o.y.eval(a, b)
+	if missingKind == x.kind || missingKind == y.kind {
+		switch o.op {
+		case "+", "-", "*", "/":
+			return value{kind: missingKind}
+		}
+		return value{kind: boolKind, b: false}
+	}
+	if x.kind != y.kind {
+		if "!=" == o.op && invalidKind != x.kind && invalidKind != y.kind {
+			return value{kind: boolKind, b: true}
+		}
+		if "==" == o.op && invalidKind != x.kind && invalidKind != y.kind {
+			return value{kind: boolKind, b: false}
+		}
+		return invalid
+	}
+	switch x.kind {
+	case numberKind:
+		switch o.op {
+		case "+":
+			return value{kind: numberKind, n: x.n + y.n}
+		case "-":
+			return value{kind: numberKind, n: x.n - y.n}
+		case "*":
+			return value{kind: numberKind, n: x.n * y.n}
+		case "/":
+			return value{kind: numberKind, n: x.n / y.n}
+		}
+		return compare(o.op, x.n < y.n, x.n == y.n)
+	case textKind:
+		return compare(o.op, x.s < y.s, x.s == y.s)
+	case boolKind:
+		switch o.op {
+		case "==":
+			return value{kind: boolKind, b: x.b == y.b}
+		case "!=":
+			return value{kind: boolKind, b: x.b != y.b}
+		}
+	}
+	return invalid
+}
+
+func compare(op string, less, equal bool) value {
+	var b bool
+	switch op {
+	case "==":
+		b = equal
+	case "!=":
+		b = !equal
+	case "<":
+		b = less
+	case "<=":
+		b = less || equal
+	case ">":
+		b = !less && !equal
+	case ">=":
+		b = !less
+	default:
+		return invalid
+	}
+	return value{kind: boolKind, b: b}
+}
+
+type call struct {
+	name string
+	args []node
+}
+
+var functions = map[string]int{
+	"abs":     1,
+	"min":     2,
+	"max":     2,
+	"missing": 1,
+}
+
+func (c call) eval(a, b *Record) value {
+	args := make([]value, len(c.args))
+	for i, n := range c.args {
+		args[i] = n.eval(a, b)
+	}
+	if "missing" == c.name {
+		return value{kind: boolKind, b: missingKind == args[0].kind}
+	}
+	for _, v := range args {
+		if numberKind != v.kind {
+			return v.orInvalid()
+		}
+	}
+	switch c.name {
+	case "abs":
+		return value{kind: numberKind, n: math.Abs(args[0].n)}
+	case "min":
+		return value{kind: numberKind, n: math.Min(args[0].n, args[1].n)}
+	case "max":
+		return value{kind: numberKind, n: math.Max(args[0].n, args[1].n)}
+	}
+	return invalid
+}
+
+type token struct {
+	text string
+	kind rune // 'n' number, 's' string, 'i' identifier, 'o' operator
+	at   int
+}
+
+type parser struct {
+	tokens  []token
+	pos     int
+	columns map[string]int
+	used    []int
+}
+
+var operators = []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "(", ")", "[", "]", ".", ","}
+
+func (p *parser) lex(s string) error {
+	for i := 0; i < len(s); {
+		c, w := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case unicode.IsSpace(c):
+			i += w
+		case unicode.IsDigit(c):
+			j := i
+			for j < len(s) && ('.' == s[j] || '0' <= s[j] && s[j] <= '9') {
+				j++
+			}
+			if r, _ := utf8.DecodeRuneInString(s[j:]); !strings.Contains(s[i:j], ".") && isNameRune(r) {
+				// a name starting with digits, like a.2nd_dose
+				j = scanName(s, j)
+				p.tokens = append(p.tokens, token{s[i:j], 'i', i})
+			} else {
+				p.tokens = append(p.tokens, token{s[i:j], 'n', i})
+			}
+			i = j
+		case '"' == c:
+			j := i + 1
+			for j < len(s) && '"' != s[j] {
+				if '\\' == s[j] {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return fmt.Errorf("rule: unterminated string at %d", i)
+			}
+			t, err := strconv.Unquote(s[i : j+1])
+			if nil != err {
+				return fmt.Errorf("rule: bad string at %d: %s", i, err)
+			}
+			p.tokens = append(p.tokens, token{t, 's', i})
+			i = j + 1
+		case unicode.IsLetter(c) || '_' == c:
+			j := scanName(s, i)
+			p.tokens = append(p.tokens, token{s[i:j], 'i', i})
+			i = j
+		default:
+			found := false
+			for _, o := range operators {
+				if strings.HasPrefix(s[i:], o) {
+					p.tokens = append(p.tokens, token{o, 'o', i})
+					i += len(o)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("rule: unexpected %q at %d", c, i)
+			}
+		}
+	}
+	return nil
+}
+
+// isNameRune returns true if c can be part of a name
+func isNameRune(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || '_' == c
+}
+
+// scanName returns the end of the name in s starting at i
+func scanName(s string, i int) int {
+	for i < len(s) {
+		c, w := utf8.DecodeRuneInString(s[i:])
+		if !isNameRune(c) {
+			break
+		}
+		i += w
+	}
+	return i
+}
+
+func (p *parser) peek() token {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return token{}
+}
+
+func (p *parser) accept(ops ...string) (string, bool) {
+	t := p.peek()
+	if 'o' != t.kind {
+		return "", false
+	}
+	for _, o := range ops {
+		if t.text == o {
+			p.pos++
+			return o, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) expect(op string) error {
+	if _, ok := p.accept(op); !ok {
+		return p.unexpected(fmt.Sprintf("expected %q", op))
+	}
+	return nil
+}
+
+func (p *parser) unexpected(why string) error {
+	if p.pos >= len(p.tokens) {
+		return fmt.Errorf("rule: %s at end", why)
+	}
+	t := p.tokens[p.pos]
+	return fmt.Errorf("rule: %s, found %q at %d", why, t.text, t.at)
+}
+
+func (p *parser) parseOr() (node, error) {
+	return p.parseLogical("||", p.parseAnd)
+}
+
+func (p *parser) parseAnd() (node, error) {
+	return p.parseLogical("&&", p.parseNot)
+}
+
+func (p *parser) parseLogical(op string, next func() (node, error)) (node, error) {
+	x, err := next()
+	if nil != err {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept(op); !ok {
+			return x, nil
+		}
+		y, err := next()
+		if nil != err {
+			return nil, err
+		}
+		x = logical{op, x, y}
+	}
+}
+
+func (p *parser) parseNot() (node, error) {
+	if _, ok := p.accept("!"); ok {
+		x, err := p.parseNot()
+		if nil != err {
+			return nil, err
+		}
+		return not{x}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *parser) parseCompare() (node, error) {
+	x, err := p.parseSum()
+	if nil != err {
+		return nil, err
+	}
+	if op, ok := p.accept("==", "!=", "<=", ">=", "<", ">"); ok {
+		y, err := p.parseSum()
+		if nil != err {
+			return nil, err
+		}
+		return binary{op, x, y}, nil
+	}
+	return x, nil
+}
+
+func (p *parser) parseSum() (node, error) {
+	return p.parseBinary([]string{"+", "-"}, p.parseProduct)
+}
+
+func (p *parser) parseProduct() (node, error) {
+	return p.parseBinary([]string{"*", "/"}, p.parseUnary)
+}
+
+func (p *parser) parseBinary(ops []string, next func() (node, error)) (node, error) {
+	x, err := next()
+	if nil != err {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept(ops...)
+		if !ok {
+			return x, nil
+		}
+		y, err := next()
+		if nil != err {
+			return nil, err
+		}
+		x = binary{op, x, y}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if _, ok := p.accept("-"); ok {
+		x, err := p.parseUnary()
+		if nil != err {
+			return nil, err
+		}
+		return negate{x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	if _, ok := p.accept("("); ok {
+		x, err := p.parseOr()
+		if nil != err {
+			return nil, err
+		}
+		return x, p.expect(")")
+	}
+	t := p.peek()
+	switch t.kind {
+	case 'n':
+		p.pos++
+		n, err := strconv.ParseFloat(t.text, 64)
+		if nil != err {
+			return nil, fmt.Errorf("rule: bad number %q at %d", t.text, t.at)
+		}
+		return literal{kind: numberKind, n: n}, nil
+	case 's':
+		p.pos++
+		return literal{kind: textKind, s: t.text}, nil
+	case 'i':
+		p.pos++
+		switch t.text {
+		case "true", "false":
+			return literal{kind: boolKind, b: "true" == t.text}, nil
+		case "a", "b":
+			return p.parseColumn("b" == t.text)
+		}
+		if n, ok := functions[t.text]; ok {
+			return p.parseCall(t.text, n)
+		}
+		return nil, fmt.Errorf("rule: unknown name %q at %d", t.text, t.at)
+	}
+	return nil, p.unexpected("expected a value")
+}
+
+func (p *parser) parseColumn(control bool) (node, error) {
+	var t token
+	if _, ok := p.accept("."); ok {
+		t = p.peek()
+		if 'n' != t.kind && 'i' != t.kind {
+			return nil, p.unexpected("expected a column")
+		}
+		p.pos++
+	} else if _, ok := p.accept("["); ok {
+		t = p.peek()
+		if 'n' != t.kind && 's' != t.kind {
+			return nil, p.unexpected("expected a column")
+		}
+		p.pos++
+		if err := p.expect("]"); nil != err {
+			return nil, err
+		}
+	} else {
+		return nil, p.unexpected("expected . or [ after record")
+	}
+	if 'n' == t.kind {
+		n, err := strconv.Atoi(t.text)
+		if nil != err || n < 1 {
+			return nil, fmt.Errorf("rule: bad column %q at %d", t.text, t.at)
+		}
+		return p.column(control, n-1), nil
+	}
+	i, ok := p.columns[t.text]
+	if !ok {
+		return nil, fmt.Errorf("rule: unknown column %q at %d", t.text, t.at)
+	}
+	if i < 0 {
+		return nil, fmt.Errorf("rule: column %q at %d is in the header more than once", t.text, t.at)
+	}
+	return p.column(control, i), nil
+}
+
+// column returns the column node at position, noting it as used
+func (p *parser) column(control bool, position int) column {
+	for _, u := range p.used {
+		if u == position {
+			return column{control, position}
+		}
+	}
+	p.used = append(p.used, position)
+	return column{control, position}
+}
+
+func (p *parser) parseCall(name string, n int) (node, error) {
+	if err := p.expect("("); nil != err {
+		return nil, err
+	}
+	c := call{name: name}
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			if err := p.expect(","); nil != err {
+				return nil, err
+			}
+		}
+		x, err := p.parseOr()
+		if nil != err {
+			return nil, err
+		}
+		c.args = append(c.args, x)
+	}
+	return c, p.expect(")")
+}
@@ -0,0 +1,127 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher_test
+
+import (
+	"reflect"
+	"testing"
+
+	. "github.com/oklasoft/mmatcher/matcher"
+)
+
+func TestRuleIsMatch(t *testing.T) {
+	a := &Record{ID: "a", Atts: []Atter{TextAtt{"F"}, NumericAtt{50}, TextAtt{"2015-03-01"}, MissingAtt{""}}}
+	b := &Record{ID: "b", Atts: []Atter{TextAtt{"F"}, NumericAtt{53}, TextAtt{"2015-04-07"}, NumericAtt{-2}}}
+	columns := map[string]int{"sex": 0, "age": 1, "date": 2, "pc1": 3, "2nd_dose": 2, "âge": 1}
+
+	tests := []struct {
+		rule     string
+		expected bool
+	}{
+		{"a.1 == b.1", true},
+		{"a.sex == b.sex", true},
+		{`a["sex"] == "F" && b[1] == "F"`, true},
+		{"abs(a.age - b.age) <= 5", true},
+		{"abs(a.age - b.age) <= 2", false},
+		{"abs(a.age - b.age) <= 2 || a.sex == b.sex", true},
+		{"!(a.sex == b.sex)", false},
+		{"b.date >= a.date", true},
+		{"b.date < a.date", false},
+		{"a.age * 2 - 3 == 97", true},
+		{"min(a.age, b.age) == 50 && max(a.age, b.age) == 53", true},
+		{"-b.pc1 == 2", true},
+		{"a.pc1 < 0", false},
+		{"a.pc1 >= 0", false},
+		{"missing(a.pc1) && !missing(b.pc1)", true},
+		{"abs(a.pc1 - b.pc1) <= 100", false},
+		{"a.sex == 1", false},
+		{"a.sex != 1", true},
+		{"a.age", false},
+		{"a.10 == b.10", false},
+		{"true", true},
+		{"b.2nd_dose >= a.2nd_dose && b.3 == b.2nd_dose", true},
+		{"abs(a.âge - b.âge) <= 3 && 2*a.âge == 100", true},
+		{"a.2 - 50 == 0", true},
+	}
+	for _, test := range tests {
+		r, err := ParseRule(test.rule, columns)
+		if nil != err {
+			t.Errorf("Expected no error parsing %s, but got %s", test.rule, err)
+			continue
+		}
+		if test.expected != r.IsMatch(a, b) {
+			t.Errorf("Expected %s to be %v for %v & %v", r, test.expected, a, b)
+		}
+	}
+}
+
+func TestParseRuleErrors(t *testing.T) {
+	for _, rule := range []string{
+		"",
+		"a.sex ==",
+		"a.nope == b.nope",
+		"c.1 == b.1",
+		"abs(a.1",
+		"abs(a.1, b.1)",
+		"a.0 == b.0",
+		`a.1 == "open`,
+		"a.1 == b.1 b.2",
+		"a.1 # b.1",
+		"nope(a.1)",
+		"a.race == b.race",
+		"a.2x == b.2x",
+		"a.é == b.é",
+		"a.1 ≥ b.1",
+	} {
+		if _, err := ParseRule(rule, map[string]int{"sex": 0, "race": -1}); nil == err {
+			t.Errorf("Expected an error parsing %q", rule)
+		}
+	}
+}
+
+func TestRuleColumns(t *testing.T) {
+	columns := map[string]int{"sex": 0, "age": 1, "date": 2}
+	tests := []struct {
+		rule     string
+		expected []int
+	}{
+		{"a.1 == b.1", []int{0}},
+		{`abs(a.age - b[2]) <= 5 && b.date >= a["date"] && a.sex == "F"`, []int{1, 2, 0}},
+		{"1 < 2", nil},
+	}
+	for _, test := range tests {
+		r, err := ParseRule(test.rule, columns)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if c := r.Columns(); !reflect.DeepEqual(test.expected, c) {
+			t.Errorf("Expected %s to use columns %v, but got %v", test.rule, test.expected, c)
+		}
+	}
+}
+
+func TestCriteriaWithRule(t *testing.T) {
+	a := Record{ID: "a", Atts: []Atter{TextAtt{"F"}, NumericAtt{50}, NumericAtt{10}}}
+	b := Records{
+		Record{ID: "b0", Atts: []Atter{TextAtt{"F"}, NumericAtt{12}, NumericAtt{60}}},
+		Record{ID: "b1", Atts: []Atter{TextAtt{"F"}, NumericAtt{48}, NumericAtt{8}}},
+		Record{ID: "b2", Atts: []Atter{TextAtt{"M"}, NumericAtt{51}, NumericAtt{11}}},
+	}
+	r, err := ParseRule("abs(a.2 - b.3) <= 10", nil)
+	if nil != err {
+		t.Fatal("Expected no error parsing, but got", err)
+	}
+	if m := a.MatchesOn(b, r); 1 != len(m) || 0 != m[0] {
+		t.Error("Expected the rule to match across columns only b0, but got", m)
+	}
+	c := Criteria{Keys{{Position: 0}}, r}
+	if m := a.MatchesOn(b, c); 1 != len(m) || 0 != m[0] {
+		t.Error("Expected keys & rule to match b0, but got", m)
+	}
+	c[0] = Keys{{Position: 1, Range: NumericAtt{5}}}
+	if m := a.MatchesOn(b, c); 0 != len(m) {
+		t.Error("Expected keys & rule to match nothing, but got", m)
+	}
+}
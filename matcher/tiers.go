@@ -0,0 +1,20 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher
+
+// Tiers is a schedule of Keys to match with, such as successively wider
+// ranges. Each tier is only tried for the cases still without enough matches
+// after all the tiers before it
+type Tiers []Keys
+
+// QuantityOptimized returns an optimized MatchSet with up to allowed controls
+// per case. The first tier is matched & optimized, then cases with fewer than
+// allowed matches are tried again with the next tier against the controls not
+// yet used. Any other Criterion in with must match in every tier. The returned
+// map gives the index of the tier at which each Pair was made
+func (t Tiers) QuantityOptimized(cases, controls Records, allowed int, with ...Criterion) (n MatchSet, made map[Pair]int) {
+	m := Matcher{Tiers: t, With: with, Allowed: allowed}
+	return m.QuantityOptimized(cases, controls)
+}
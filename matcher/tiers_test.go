@@ -0,0 +1,98 @@
+// Copyright 2015 Stuart Glenn, OMRF. All rights reserved.
+// Use of this code is governed by a 3 clause BSD style license
+// Full license details in LICENSE file distributed with this software
+
+package matcher_test
+
+import (
+	"testing"
+
+	. "github.com/oklasoft/mmatcher/matcher"
+)
+
+func TestTiersQuantityOptimized(t *testing.T) {
+	a := Records{
+		Record{ID: "a1", Atts: []Atter{NumericAtt{20}}},
+		Record{ID: "a2", Atts: []Atter{NumericAtt{40}}},
+		Record{ID: "a3", Atts: []Atter{NumericAtt{60}}},
+	}
+	b := Records{
+		Record{ID: "b1", Atts: []Atter{NumericAtt{21}}},
+		Record{ID: "b2", Atts: []Atter{NumericAtt{45}}},
+		Record{ID: "b3", Atts: []Atter{NumericAtt{22}}},
+		Record{ID: "b4", Atts: []Atter{NumericAtt{80}}},
+	}
+	tiers := Tiers{
+		Keys{{Position: 0, Range: NumericAtt{2}}},
+		Keys{{Position: 0, Range: NumericAtt{5}}},
+		Keys{{Position: 0, Range: NumericAtt{10}}},
+	}
+
+	o, made := tiers.QuantityOptimized(a, b, 1)
+	if 2 != o.NumPairs() {
+		t.Fatal("Expected 2 pairs after all tiers, but got", o)
+	}
+	tests := []struct {
+		pair Pair
+		tier int
+	}{
+		{NewPair("a2", "b2"), 1},
+	}
+	for _, test := range tests {
+		if tier, ok := made[test.pair]; !ok || test.tier != tier {
+			t.Errorf("Expected %v to be made at tier %d, but was %d in %v", test.pair, test.tier, tier, made)
+		}
+	}
+	if m := o.MatchesFor("a1"); 1 != len(m) || 0 != made[NewPair("a1", m[0])] {
+		t.Error("Expected a1 to be matched in the first tier, but got", m, made)
+	}
+	if m := o.MatchesFor("a3"); 0 != len(m) {
+		t.Error("Expected a3 to have no matches in any tier, but got", m)
+	}
+
+	o, made = tiers.QuantityOptimized(a, b, 2)
+	if 3 != o.NumPairs() {
+		t.Fatal("Expected 3 pairs after all tiers allowing 2, but got", o)
+	}
+	if m := o.MatchesFor("a1"); 2 != len(m) {
+		t.Error("Expected a1 to have 2 matches, but got", m)
+	}
+	for p, tier := range made {
+		if 2 == tier {
+			t.Error("Expected no pairs from the last tier, but got", p)
+		}
+	}
+
+	o, _ = Tiers{}.QuantityOptimized(a, b, 1)
+	if 0 != o.NumPairs() {
+		t.Error("Expected no pairs without any tiers, but got", o)
+	}
+}
+
+func TestTiersRemainingQuota(t *testing.T) {
+	a := Records{
+		Record{ID: "a1", Atts: []Atter{TextAtt{"x"}, NumericAtt{10}}},
+		Record{ID: "a2", Atts: []Atter{TextAtt{"y"}, NumericAtt{11}}},
+	}
+	b := Records{
+		Record{ID: "b0", Atts: []Atter{TextAtt{"x"}, NumericAtt{50}}},
+		Record{ID: "b1", Atts: []Atter{TextAtt{"z"}, NumericAtt{10.5}}},
+		Record{ID: "b2", Atts: []Atter{TextAtt{"z"}, NumericAtt{10.5}}},
+		Record{ID: "b3", Atts: []Atter{TextAtt{"z"}, NumericAtt{12}}},
+	}
+	tiers := Tiers{
+		Keys{{Position: 0}},
+		Keys{{Position: 1, Range: NumericAtt{1}}},
+	}
+
+	o, made := tiers.QuantityOptimized(a, b, 2)
+	if 0 != made[NewPair("a1", "b0")] {
+		t.Fatal("Expected a1 to match b0 in the first tier, but got", made)
+	}
+	if 4 != o.NumPairs() {
+		t.Fatal("Expected 4 pairs, a1 only taking the 1 more it needs in the second tier, but got", o)
+	}
+	if m := o.MatchesFor("a2"); 2 != len(m) {
+		t.Error("Expected a2 to have 2 matches, but got", m)
+	}
+}